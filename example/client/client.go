@@ -1,28 +1,39 @@
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
 	"git.baijiashilian.com/shared/brtc/webtransport-go"
-	"github.com/lucas-clemente/quic-go"
 	"github.com/paypal/hera/utility/encoding/netstring"
 )
 
 func main() {
-	client := webtransport.CreateWebTransportClient(webtransport.ClientConfig{
+	var client *webtransport.WebTransportClient
+	client = webtransport.CreateWebTransportClient(webtransport.ClientConfig{
 		Path: "/room",
 		// RemoteAddr: "localhost:4433",
 		RemoteAddr: "brtc-pslocal.baijiayun.com:4433",
 		// RemoteAddr: "brtc-pslocal.iirii.com:4433",
 		// InsecureSkipVerify: true,
+		// sha-256 printed by `go run ./example/server/server.go gencert`
+		// ServerCertificateHashes: [][]byte{hash},
+		OnMessage: func(message []byte) {
+			log.Printf("[AC]webtransport receive message: %v", string(message))
+			client.SendMessage(message)
+		},
 	})
 
 	go func(client *webtransport.WebTransportClient) {
-		for stream := range client.Stream {
+		for {
+			stream, err := client.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
 			log.Printf("webtransport stream %d", stream.StreamID())
 
-			go func(str quic.Stream) {
+			go func(str *webtransport.Stream) {
 				defer str.Close()
 				decoder := netstring.NewNetstringReader(str)
 				for {
@@ -38,14 +49,9 @@ func main() {
 				}
 			}(stream)
 		}
-
-		client.OnMessage = func(message []byte) {
-			log.Printf("[AC]webtransport receive message: %v", string(message))
-			client.SendMessage(message)
-		}
 	}(client)
 
-	err := client.Connect()
+	err := client.Connect(context.Background())
 	if err != nil {
 		log.Fatal(err)
 		return
@@ -57,7 +63,7 @@ func main() {
 		return
 	}
 
-	go func(stream quic.Stream) {
+	go func(stream *webtransport.Stream) {
 		defer stream.Close()
 		decoder := netstring.NewNetstringReader(stream)
 		for {
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"git.baijiashilian.com/shared/brtc/webtransport-go"
+)
+
+// handleRestart makes kill -USR2 hand the socket to a new process and drain
+// the sessions.
+func handleRestart(server *webtransport.WebTransportServer) {
+	restart := make(chan os.Signal, 1)
+	signal.Notify(restart, syscall.SIGUSR2)
+	go func() {
+		for range restart {
+			process, err := server.Restart()
+			if err != nil {
+				log.Printf("restart failed: %v", err)
+				continue
+			}
+			log.Printf("restarted as process %d, draining", process.Pid)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("shutdown: %v", err)
+			}
+			cancel()
+			return
+		}
+	}()
+}
@@ -0,0 +1,6 @@
+package main
+
+import "git.baijiashilian.com/shared/brtc/webtransport-go"
+
+// handleRestart does nothing, Restart is not supported on windows.
+func handleRestart(server *webtransport.WebTransportServer) {}
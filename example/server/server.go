@@ -1,19 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
 	"io"
 	"log"
+	"os"
 	"strings"
+	"time"
 
 	"git.baijiashilian.com/shared/brtc/webtransport-go"
-	"github.com/lucas-clemente/quic-go"
 	"github.com/paypal/hera/utility/encoding/netstring"
 
 	_ "net/http/pprof"
 )
 
-func handleCounterReceiveStream(tag string, str quic.ReceiveStream) {
-	go func(str quic.ReceiveStream) {
+func handleCounterReceiveStream(tag string, str *webtransport.ReceiveStream) {
+	go func(str *webtransport.ReceiveStream) {
 		for {
 			buf := make([]byte, 4096)
 			n, err := str.Read(buf)
@@ -32,7 +38,39 @@ func handleCounterReceiveStream(tag string, str quic.ReceiveStream) {
 	}(str)
 }
 
+// generateCertificate implements the gencert subcommand: it writes a short-lived
+// self-signed certificate for local development and prints its hash for
+// serverCertificateHashes.
+func generateCertificate(args []string) {
+	flags := flag.NewFlagSet("gencert", flag.ExitOnError)
+	certPath := flags.String("cert", "webtransport.crt", "output certificate path")
+	keyPath := flags.String("key", "webtransport.key", "output key path")
+	hosts := flags.String("hosts", "localhost,127.0.0.1,::1", "comma separated DNS names and IPs")
+	validity := flags.Duration("validity", webtransport.DefaultCertificateValidity, "certificate validity, less than 336h")
+	_ = flags.Parse(args)
+
+	certPEM, keyPEM, err := webtransport.GenerateCertificate(strings.Split(*hosts, ","), *validity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*certPath, certPEM, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*keyPath, keyPEM, 0600); err != nil {
+		log.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	fmt.Printf("certificate: %s\nkey: %s\nexpires: %s\nsha-256: %s\n",
+		*certPath, *keyPath, time.Now().Add(*validity).Format(time.RFC3339),
+		base64.StdEncoding.EncodeToString(webtransport.CertificateHash(block.Bytes)))
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gencert" {
+		generateCertificate(os.Args[2:])
+		return
+	}
+
 	server := webtransport.CreateWebTransportServer(webtransport.ServerConfig{
 		ListenAddr: ":4433",
 		//TLSCertPath:    "./data/certs/baijiayun.com.crt",
@@ -58,7 +96,7 @@ func main() {
 						return
 					}
 
-					handleCounterReceiveStream("ServerTransportCreateStream", stream)
+					handleCounterReceiveStream("ServerTransportCreateStream", stream.ReceiveStream)
 
 					stream.Write([]byte("server counter stream test"))
 				}(transport)
@@ -72,26 +110,40 @@ func main() {
 					stream.Write([]byte("server counter unistream test"))
 				}(transport)
 
-				transport.OnMessage = func(message []byte) {
-					log.Printf("[counter]webtransport on message: %v", string(message))
+				go func(transport *webtransport.WebTransport) {
+					for {
+						message, err := transport.ReceiveDatagram(context.Background())
+						if err != nil {
+							return
+						}
+						log.Printf("[counter]webtransport on message: %v", string(message))
 
-					s := strings.ToUpper(string(message))
+						s := strings.ToUpper(string(message))
 
-					transport.SendMessage([]byte(s))
-				}
+						transport.SendMessage([]byte(s))
+					}
+				}(transport)
 
 				go func(transport *webtransport.WebTransport) {
-					for receiveStream := range transport.ReceiveStream {
-						log.Printf("[counter]range for webtransport unistream %d", receiveStream.StreamID())
+					for {
+						receiveStream, err := transport.AcceptUniStream(context.Background())
+						if err != nil {
+							return
+						}
+						log.Printf("[counter]accepted webtransport unistream %d", receiveStream.StreamID())
 						handleCounterReceiveStream("ServerTransportReceiveStream", receiveStream)
 					}
 				}(transport)
 
 				go func(transport *webtransport.WebTransport) {
-					for stream := range transport.Stream {
-						log.Printf("[counter]range for webtransport stream %d", stream.StreamID())
-
-						go func(str quic.Stream) {
+					for {
+						stream, err := transport.AcceptStream(context.Background())
+						if err != nil {
+							return
+						}
+						log.Printf("[counter]accepted webtransport stream %d", stream.StreamID())
+
+						go func(str *webtransport.Stream) {
 							defer str.Close()
 
 							for {
@@ -125,10 +177,14 @@ func main() {
 				log.Printf("webtransport path %s", transport.Req.URL)
 
 				go func(transport *webtransport.WebTransport) {
-					for stream := range transport.Stream {
-						log.Printf("[room]range fo webtransport stream %d", stream.StreamID())
-
-						go func(str quic.Stream) {
+					for {
+						stream, err := transport.AcceptStream(context.Background())
+						if err != nil {
+							return
+						}
+						log.Printf("[room]accepted webtransport stream %d", stream.StreamID())
+
+						go func(str *webtransport.Stream) {
 							defer str.Close()
 							decoder := netstring.NewNetstringReader(str)
 							for {
@@ -145,10 +201,16 @@ func main() {
 					}
 				}(transport)
 
-				transport.OnMessage = func(message []byte) {
-					log.Printf("[room]webtransport on message: %v", string(message))
-					transport.SendMessage(message)
-				}
+				go func(transport *webtransport.WebTransport) {
+					for {
+						message, err := transport.ReceiveDatagram(context.Background())
+						if err != nil {
+							return
+						}
+						log.Printf("[room]webtransport on message: %v", string(message))
+						transport.SendMessage(message)
+					}
+				}(transport)
 
 				return
 			}
@@ -157,7 +219,9 @@ func main() {
 		}
 	}()
 
-	if err := server.Run(); err != nil {
+	handleRestart(server)
+
+	if err := server.Run(); err != nil && err != webtransport.ErrServerClosed {
 		log.Fatal(err)
 	}
 }
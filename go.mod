@@ -7,6 +7,7 @@ require (
 	github.com/marten-seemann/qpack v0.2.1
 	github.com/paypal/hera v0.0.0-20220124213244-61e16e937980
 	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
 )
 
 require (
@@ -20,7 +21,6 @@ require (
 	github.com/onsi/ginkgo v1.16.4 // indirect
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
 	golang.org/x/mod v0.4.2 // indirect
-	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 	golang.org/x/text v0.3.6 // indirect
 	golang.org/x/tools v0.1.1 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
@@ -1,7 +1,6 @@
 package h3
 
 import (
-	"crypto/tls"
 	"errors"
 	"net/http"
 	"net/url"
@@ -11,6 +10,8 @@ import (
 	"github.com/marten-seemann/qpack"
 )
 
+// RequestFromHeaders builds a request from decoded header fields. TLS is left
+// nil, the caller sets it from the QUIC connection state.
 func RequestFromHeaders(headers []qpack.HeaderField) (*http.Request, error) {
 	var path, authority, method, contentLengthStr, protocol string
 	httpHeaders := http.Header{}
@@ -85,10 +86,11 @@ func RequestFromHeaders(headers []qpack.HeaderField) (*http.Request, error) {
 		ContentLength: contentLength,
 		Host:          authority,
 		RequestURI:    requestURI,
-		TLS:           &tls.ConnectionState{},
 	}, nil
 }
 
+// ResponseFromHeaders builds a response from decoded header fields. TLS is
+// left nil, the client only checks the status code.
 func ResponseFromHeaders(headers []qpack.HeaderField) (*http.Response, error) {
 
 	var statusCode int
@@ -113,7 +115,6 @@ func ResponseFromHeaders(headers []qpack.HeaderField) (*http.Response, error) {
 		Proto:      "webtransport",
 		Status:     statusText,
 		StatusCode: statusCode,
-		TLS:        &tls.ConnectionState{},
 		Header:     httpHeaders,
 		Body:       nil,
 	}, nil
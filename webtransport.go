@@ -1,39 +1,95 @@
 package webtransport
 
 import (
-	"bytes"
-	"context"
 	"errors"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/quicvarint"
 )
 
-type WebTransport struct {
-	session quic.Session
-	Req     *http.Request
+// DefaultAcceptQueueSize is the number of accepted streams per session
+// waiting for AcceptStream or AcceptUniStream when no size is configured.
+const DefaultAcceptQueueSize = 16
 
-	// Incoming bidirectional HTTP/3 streams (e.g. WebTransport)
-	Stream chan quic.Stream
+// https://www.ietf.org/archive/id/draft-ietf-webtrans-http3-02.html#section-9.5
+const WEBTRANSPORT_BUFFERED_STREAM_REJECTED = 0x3994bd84
 
-	// Incoming unidirectional HTTP/3 streams (e.g. WebTransport)
-	ReceiveStream chan quic.ReceiveStream
+// CLOSE_WEBTRANSPORT_SESSION capsule sent on the CONNECT stream with the code
+// and reason of Close, the reason is at most maxCloseReasonLength bytes.
+// https://www.ietf.org/archive/id/draft-ietf-webtrans-http3-02.html
+const (
+	closeWebTransportSessionCapsule = 0x2843
+	maxCloseReasonLength            = 1024
+)
 
-	OnMessage func([]byte)
+// DefaultStreamHeaderTimeout bounds reading the stream type and session ID of
+// an incoming stream when no timeout is configured.
+const DefaultStreamHeaderTimeout = 1 * time.Second
 
-	OnClose func()
+// https://www.rfc-editor.org/rfc/rfc9114.html#section-8.1
+const (
+	H3_NO_ERROR              = 0x100
+	H3_INTERNAL_ERROR        = 0x102
+	H3_STREAM_CREATION_ERROR = 0x103
+	H3_SETTINGS_ERROR        = 0x109
+	H3_REQUEST_CANCELLED     = 0x10c
+	H3_REQUEST_INCOMPLETE    = 0x10d
+	H3_MESSAGE_ERROR         = 0x10e
+)
 
-	sessionId uint64
+// HTTP/3 unidirectional stream types that must not be cancelled,
+// see https://www.rfc-editor.org/rfc/rfc9114.html#section-6.2
+const (
+	controlStreamType      = 0x00
+	qpackEncoderStreamType = 0x02
+	qpackDecoderStreamType = 0x03
+)
 
-	connectStream quic.Stream
+// datagramQueueSize bounds the datagrams waiting for ReceiveDatagram, newer
+// datagrams are dropped when it is full.
+const datagramQueueSize = 128
 
-	settingsStream quic.ReceiveStream
+// WebTransport is a session accepted by WebTransportServer.
+type WebTransport struct {
+	*webtransportSession
+	Req *http.Request
 
-	closed bool
+	conn *serverConn
+}
+
+// StreamStats counts the incoming streams rejected by a session.
+type StreamStats struct {
+	// HeaderTimeouts did not send the stream type and session ID in time.
+	HeaderTimeouts uint64
+	// InvalidStreamTypes did not carry the expected WebTransport stream type.
+	InvalidStreamTypes uint64
+	// QueueFull arrived while the accept queue was full.
+	QueueFull uint64
+	// PendingDropped arrived before their session was established and were
+	// rejected because the buffer was full or they expired.
+	PendingDropped uint64
+}
+
+type streamStats struct {
+	headerTimeouts     uint64
+	invalidStreamTypes uint64
+	queueFull          uint64
+	pendingDropped     uint64
+}
+
+func (s *streamStats) snapshot() StreamStats {
+	return StreamStats{
+		HeaderTimeouts:     atomic.LoadUint64(&s.headerTimeouts),
+		InvalidStreamTypes: atomic.LoadUint64(&s.invalidStreamTypes),
+		QueueFull:          atomic.LoadUint64(&s.queueFull),
+		PendingDropped:     atomic.LoadUint64(&s.pendingDropped),
+	}
 }
 
 type byteReader interface {
@@ -48,6 +104,9 @@ const (
 	WebTransportUniStream = 0x54
 )
 
+// ALPN protocols offered by both client and server.
+var nextProtos = []string{"h3", "h3-32", "h3-31", "h3-30", "h3-29"}
+
 func (br *byteReaderImpl) ReadByte() (byte, error) {
 	b := make([]byte, 1)
 	if _, err := br.Reader.Read(b); err != nil {
@@ -56,275 +115,132 @@ func (br *byteReaderImpl) ReadByte() (byte, error) {
 	return b[0], nil
 }
 
-func createWebTransport(session quic.Session, req *http.Request, connectStream quic.Stream, settingsStream quic.ReceiveStream) *WebTransport {
-	transport := &WebTransport{
-		session:        session,
-		Req:            req,
-		Stream:         make(chan quic.Stream),
-		ReceiveStream:  make(chan quic.ReceiveStream),
-		sessionId:      0,
-		connectStream:  connectStream,
-		settingsStream: settingsStream,
+// readStreamHeader reads the stream type and session ID that prefix every
+// WebTransport stream. Streams that are too slow or of another type are
+// cancelled and counted, except the HTTP/3 critical unidirectional streams,
+// which are left alone. The read deadline is cleared again on success.
+func readStreamHeader(stream quic.ReceiveStream, wantType uint64, timeout time.Duration, stats *streamStats) (uint64, bool) {
+	streamType, ok := readStreamType(stream, timeout, stats)
+	if !ok {
+		return 0, false
 	}
-
-	go func() {
-		for {
-			stream, err := session.AcceptUniStream(session.Context())
-			if err != nil {
-				transport.close()
-				return
-			}
-
-			if transport.session == nil {
-				return
-			}
-
-			if stream.StreamID() == transport.settingsStream.StreamID() {
-				log.Printf("[AcceptUniStream]createWebTransport.accepted connectStream streamId: %d", stream.StreamID())
-				continue
-			}
-
-			go func(stream quic.ReceiveStream) {
-				ctx := context.Background()
-				done := make(chan struct{}, 1)
-				go func(ctx context.Context) {
-					defer func() {
-						done <- struct{}{}
-					}()
-
-					br, ok := stream.(byteReader)
-					if !ok {
-						br = &byteReaderImpl{stream}
-					}
-					streamType, err := quicvarint.Read(br)
-					if err != nil {
-						return
-					}
-					sessionId, err := quicvarint.Read(br)
-					if err != nil {
-						return
-					}
-
-					if streamType == WebTransportUniStream {
-						log.Printf("[AcceptStream.WebTransportUniStream]receiveStream accepted streamId: %d, sessionId: %d", stream.StreamID(), sessionId)
-
-						transport.sessionId = sessionId
-						transport.ReceiveStream <- stream
-					}
-				}(ctx)
-
-				select {
-				case <-done:
-					return
-				// 如果是 webtransport stream 则一定会读取到头数据，否则超时退出
-				case <-time.After(time.Duration(1 * time.Second)):
-					return
-				}
-
-			}(stream)
-		}
-	}()
-
-	go func() {
-		for {
-			stream, err := session.AcceptStream(session.Context())
-			if err != nil {
-				transport.close()
-				return
-			}
-
-			if transport.session == nil {
-				return
-			}
-
-			if stream.StreamID() == transport.connectStream.StreamID() {
-				log.Printf("[AcceptStream]createWebTransport.accepted connectStream streamId: %d", stream.StreamID())
-				continue
-			}
-
-			go func(stream quic.Stream) {
-				ctx := context.Background()
-				done := make(chan struct{}, 1)
-				go func(ctx context.Context) {
-					defer func() {
-						done <- struct{}{}
-					}()
-
-					br, ok := stream.(byteReader)
-					if !ok {
-						br = &byteReaderImpl{stream}
-					}
-					streamType, err := quicvarint.Read(br)
-					if err != nil {
-						return
-					}
-					sessionId, err := quicvarint.Read(br)
-					if err != nil {
-						return
-					}
-
-					if streamType == WebTransportStream {
-						log.Printf("[AcceptStream.WebTransportStream]stream accepted streamId: %d, sessionId: %d", stream.StreamID(), sessionId)
-
-						transport.sessionId = sessionId
-						transport.Stream <- stream
-					}
-				}(ctx)
-
-				select {
-				case <-done:
-					return
-				// 如果是 webtransport stream 则一定会读取到头数据，否则超时退出
-				case <-time.After(time.Duration(1 * time.Second)):
-					return
-				}
-			}(stream)
-		}
-	}()
-
-	go func() {
-		for {
-			msg, err := session.ReceiveMessage()
-			if err != nil {
-				transport.close()
-				return
-			}
-			log.Printf("[webtransport]ReceiveMessage: %v", string(msg))
-
-			if len(msg) > 0 {
-				// TODO https://datatracker.ietf.org/doc/draft-ietf-webtrans-http3/ Session Termination 结束 session
-				if transport.OnMessage != nil {
-					buf := &bytes.Buffer{}
-					buf.Write(msg)
-
-					sessionId, err := quicvarint.Read(buf)
-					if err != nil || sessionId != transport.sessionId {
-						log.Printf("[webtransport]ReceiveMessage format error, ignore it, sessionId: %d", sessionId)
-						continue
-					}
-
-					transport.OnMessage(buf.Bytes())
-				}
-			}
-		}
-	}()
-
-	go func() {
-		for {
-			buf := make([]byte, 1024)
-			n, err := connectStream.Read(buf)
-			if n > 0 {
-				log.Printf("[webtransport]connect stream accepted data, but ignore,read message: (n: %d)%v", n, string(buf))
-			}
-
-			if err == io.EOF {
-				transport.close()
-				return
-			}
-			if err != nil {
-				transport.close()
-				return
-			}
-		}
-	}()
-
-	return transport
+	if streamType != wantType {
+		rejectStreamType(stream, streamType, stats)
+		return 0, false
+	}
+	return readSessionId(stream, stats)
 }
 
-func (transport *WebTransport) CreateStream() (quic.Stream, error) {
-	if transport.session == nil {
-		return nil, errors.New("session is nil")
+// readStreamType sets the header deadline and reads the first varint of an
+// incoming stream: the stream type, or the frame type on request streams.
+func readStreamType(stream quic.ReceiveStream, timeout time.Duration, stats *streamStats) (uint64, bool) {
+	if err := stream.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, false
 	}
-
-	stream, err := transport.session.OpenStream()
-
+	br, ok := stream.(byteReader)
+	if !ok {
+		br = &byteReaderImpl{stream}
+	}
+	streamType, err := quicvarint.Read(br)
 	if err != nil {
-		return nil, err
+		rejectSlowStream(stream, err, stats)
+		return 0, false
 	}
-
-	buf := &bytes.Buffer{}
-
-	quicvarint.Write(buf, WebTransportStream)
-	quicvarint.Write(buf, transport.sessionId)
-
-	stream.Write(buf.Bytes())
-
-	return stream, nil
+	return streamType, true
 }
 
-func (transport *WebTransport) CreateUniStream() (quic.SendStream, error) {
-	if transport.session == nil {
-		return nil, errors.New("session is nil")
+// readSessionId reads the session ID following the stream type and clears the
+// header deadline.
+func readSessionId(stream quic.ReceiveStream, stats *streamStats) (uint64, bool) {
+	br, ok := stream.(byteReader)
+	if !ok {
+		br = &byteReaderImpl{stream}
 	}
-
-	stream, err := transport.session.OpenUniStream()
-
+	sessionId, err := quicvarint.Read(br)
 	if err != nil {
-		return nil, err
+		rejectSlowStream(stream, err, stats)
+		return 0, false
 	}
-
-	buf := &bytes.Buffer{}
-	quicvarint.Write(buf, WebTransportUniStream)
-	quicvarint.Write(buf, transport.sessionId)
-	stream.Write(buf.Bytes())
-
-	return stream, nil
+	if err := stream.SetReadDeadline(time.Time{}); err != nil {
+		return 0, false
+	}
+	return sessionId, true
 }
 
-func (transport *WebTransport) SendMessage(message []byte) error {
-
-	buf := &bytes.Buffer{}
-
-	quicvarint.Write(buf, transport.sessionId)
-	buf.Write(message)
-
-	if transport.session == nil {
-		return errors.New("session is nil")
+// rejectStreamType cancels a stream of an unexpected type, the HTTP/3
+// critical unidirectional streams are left open.
+func rejectStreamType(stream quic.ReceiveStream, streamType uint64, stats *streamStats) {
+	if _, ok := stream.(quic.SendStream); !ok && isCriticalStreamType(streamType) {
+		_ = stream.SetReadDeadline(time.Time{})
+		return
 	}
-
-	return transport.session.SendMessage(buf.Bytes())
+	log.Printf("[readStreamHeader]unexpected stream type 0x%x, reject streamId: %d", streamType, stream.StreamID())
+	atomic.AddUint64(&stats.invalidStreamTypes, 1)
+	rejectStream(stream, H3_STREAM_CREATION_ERROR)
 }
 
-func (transport *WebTransport) close() {
+// quarterStreamId prefixes datagrams, see
+// https://datatracker.ietf.org/doc/html/draft-ietf-masque-h3-datagram-05#section-3
+func quarterStreamId(sessionId uint64) uint64 {
+	return sessionId / 4
+}
 
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("transport closed error : %+q \n", err)
-		}
-	}()
+func isCriticalStreamType(streamType uint64) bool {
+	return streamType == controlStreamType || streamType == qpackEncoderStreamType || streamType == qpackDecoderStreamType
+}
 
-	if transport.closed {
-		return
+func rejectSlowStream(stream quic.ReceiveStream, err error, stats *streamStats) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		log.Printf("[readStreamHeader]stream header timeout, reject streamId: %d", stream.StreamID())
+		atomic.AddUint64(&stats.headerTimeouts, 1)
 	}
+	rejectStream(stream, H3_REQUEST_INCOMPLETE)
+}
 
-	if transport.session == nil {
-		return
+// rejectStream cancels the receive side of a stream, and the send side too
+// for bidirectional streams.
+func rejectStream(stream quic.ReceiveStream, code quic.StreamErrorCode) {
+	stream.CancelRead(code)
+	if sendStream, ok := stream.(quic.SendStream); ok {
+		sendStream.CancelWrite(code)
 	}
+}
 
-	transport.session = nil
-
-	transport.closed = true
-
-	close(transport.Stream)
-	close(transport.ReceiveStream)
-
-	// self gc
-	transport.connectStream = nil
-	transport.settingsStream = nil
-	transport.Req = nil
-	transport.ReceiveStream = nil
-	transport.Stream = nil
-
-	if transport.OnClose != nil {
-		transport.OnClose()
+func createWebTransport(conn *serverConn, req *http.Request, connectStream quic.Stream) *WebTransport {
+	config := &conn.server.ServerConfig
+	transport := &WebTransport{
+		webtransportSession: newWebTransportSession(StateOpen, config.AcceptQueueSize, &conn.stats),
+		Req:                 req,
+		conn:                conn,
 	}
+	transport.outer = transport
+	transport.session = conn.session
+	transport.sessionId = uint64(connectStream.StreamID())
+	transport.connectStream = connectStream
+	transport.lazyStreamHeader = config.LazyStreamHeader
+	if config.OnMessage != nil {
+		transport.onMessage = func(msg []byte) {
+			config.OnMessage(transport, msg)
+		}
+	}
+	transport.onClose = func() {
+		conn.unregister(transport)
+		if config.OnClose != nil {
+			config.OnClose(transport)
+		}
+	}
+	return transport
 }
 
-func (transport *WebTransport) Close(code quic.ApplicationErrorCode, message string) error {
-	if transport.session == nil {
-		return errors.New("session is not opened")
+// deliver hands a stream or datagram dispatched by the connection to the session.
+func (transport *WebTransport) deliver(item *pendingItem) {
+	switch stream := item.stream.(type) {
+	case nil:
+		transport.handleDatagram(item.datagram)
+	case quic.Stream:
+		transport.handleStream(stream)
+	default:
+		transport.handleUniStream(stream)
 	}
-	//err := transport.session.CloseWithError(code, message)
-	transport.close()
-	return nil
 }
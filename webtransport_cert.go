@@ -0,0 +1,301 @@
+package webtransport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateLoader serves a certificate pair loaded from disk and swaps it
+// when the files change. A pair that fails to load never replaces the
+// current one, so running and new handshakes keep working.
+type certificateLoader struct {
+	certPath string
+	keyPath  string
+
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+
+	// modification times of the last attempted load
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertificateLoader(certPath, keyPath string) (*certificateLoader, error) {
+	loader := &certificateLoader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+	if err := loader.reload(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+func (l *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.cert, nil
+}
+
+func (l *certificateLoader) reload() error {
+	certModTime, keyModTime, err := l.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certPath, l.keyPath)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.certModTime = certModTime
+	l.keyModTime = keyModTime
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	l.cert = &cert
+	return nil
+}
+
+func (l *certificateLoader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(l.certPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("load certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(l.keyPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("load certificate: %w", err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// changed reports whether either file was modified since the last load attempt.
+func (l *certificateLoader) changed() bool {
+	certModTime, keyModTime, err := l.modTimes()
+	if err != nil {
+		// the files may be in the middle of a rotation, try again on the next tick
+		return false
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return !certModTime.Equal(l.certModTime) || !keyModTime.Equal(l.keyModTime)
+}
+
+// watch polls the certificate files every interval until done is closed.
+func (l *certificateLoader) watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !l.changed() {
+				continue
+			}
+			if err := l.reload(); err != nil {
+				log.Printf("certificate reload failed, keep serving the current one: %v", err)
+				continue
+			}
+			log.Printf("certificate reloaded from %s", l.certPath)
+		}
+	}
+}
+
+// ReloadCertificates reloads TLSCertPath/TLSKeyPath. New handshakes use the
+// new pair, established sessions are not affected. On error the current
+// certificate is kept.
+func (s *WebTransportServer) ReloadCertificates() error {
+	s.mutex.Lock()
+	certificates := s.certificates
+	s.mutex.Unlock()
+	if certificates == nil {
+		return errors.New("certificates are not loaded from TLSCertPath/TLSKeyPath")
+	}
+	return certificates.reload()
+}
+
+// MaxCertificateValidity is the longest validity browsers accept for
+// certificates pinned with serverCertificateHashes.
+const MaxCertificateValidity = 14 * 24 * time.Hour
+
+// DefaultCertificateValidity is used for generated certificates when
+// ServerConfig.CertificateValidity is not set.
+const DefaultCertificateValidity = 10 * 24 * time.Hour
+
+// GenerateCertificate creates a self-signed ECDSA P-256 certificate for hosts
+// (DNS names or IP addresses) valid from now for validity. The certificate
+// and key are PEM encoded.
+func GenerateCertificate(hosts []string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	if validity <= 0 || validity >= MaxCertificateValidity {
+		return nil, nil, fmt.Errorf("certificate validity must be in (0, %s)", MaxCertificateValidity)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// backdate a little to tolerate clock skew, it still counts towards the validity
+	notBefore := time.Now().Add(-time.Hour)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "webtransport"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// CertificateHash returns the SHA-256 hash of a DER encoded certificate, the
+// value expected by serverCertificateHashes.
+func CertificateHash(certDER []byte) []byte {
+	hash := sha256.Sum256(certDER)
+	return hash[:]
+}
+
+// selfSignedCertificate serves a generated certificate and replaces it with a
+// fresh one when half of its validity has passed.
+type selfSignedCertificate struct {
+	hosts    []string
+	validity time.Duration
+
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+}
+
+func newSelfSignedCertificate(hosts []string, validity time.Duration) (*selfSignedCertificate, error) {
+	c := &selfSignedCertificate{
+		hosts:    hosts,
+		validity: validity,
+	}
+	if err := c.rotate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *selfSignedCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+func (c *selfSignedCertificate) rotate() error {
+	certPEM, keyPEM, err := GenerateCertificate(c.hosts, c.validity)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.cert = &cert
+	c.mutex.Unlock()
+	return nil
+}
+
+// watch rotates the certificate every half validity until done is closed.
+func (c *selfSignedCertificate) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(c.validity / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := c.rotate(); err != nil {
+				log.Printf("self-signed certificate rotation failed, keep serving the current one: %v", err)
+				continue
+			}
+			cert, _ := c.getCertificate(nil)
+			log.Printf("self-signed certificate rotated, sha-256: %s", base64.StdEncoding.EncodeToString(CertificateHash(cert.Certificate[0])))
+		}
+	}
+}
+
+type certificateHash struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"value"`
+}
+
+// CertificateHash returns the SHA-256 hash of the certificate currently
+// served, or nil when certificates come from TLSConfig or GetCertificate.
+func (s *WebTransportServer) CertificateHash() []byte {
+	s.mutex.Lock()
+	getCertificate := s.getCertificate
+	s.mutex.Unlock()
+	if getCertificate == nil {
+		return nil
+	}
+	cert, _ := getCertificate(nil)
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	return CertificateHash(cert.Certificate[0])
+}
+
+// CertificateHashHandler serves the current certificate hash in the format of
+// the WebTransport serverCertificateHashes option, e.g.
+// [{"algorithm":"sha-256","value":"<base64>"}].
+func (s *WebTransportServer) CertificateHashHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := s.CertificateHash()
+		if hash == nil {
+			http.Error(w, "certificate hash not available", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		_ = json.NewEncoder(w).Encode([]certificateHash{{
+			Algorithm: "sha-256",
+			Value:     base64.StdEncoding.EncodeToString(hash),
+		}})
+	})
+}
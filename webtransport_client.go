@@ -4,17 +4,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
-	"io"
+	"fmt"
 	"log"
-	"net/http"
-	"net/url"
+	"sync"
 	"time"
 
-	"git.baijiashilian.com/shared/brtc/webtransport-go/h3"
 	"github.com/lucas-clemente/quic-go"
-	"github.com/lucas-clemente/quic-go/quicvarint"
-	"github.com/marten-seemann/qpack"
 )
 
 // Config for WebTransportServerQuic.
@@ -22,10 +19,37 @@ type ClientConfig struct {
 	// remoteAddr sets an address to connect server.
 	RemoteAddr string
 
+	// Endpoints replaces RemoteAddr with a list of servers tried in turn,
+	// see WebTransportClient.Endpoint for the one connected to.
+	Endpoints *Endpoints
+
+	// Dialer opens the QUIC connection, a zero Dialer is used when nil.
+	Dialer *Dialer
+
+	// Certificates are presented to servers that require mTLS.
 	Certificates []tls.Certificate
 
+	// RootCAs verifies the server certificate, the system pool is used when nil.
+	RootCAs *x509.CertPool
+
 	InsecureSkipVerify bool
 
+	// ServerCertificateHashes pins the server certificate like the browser
+	// serverCertificateHashes option: chain verification is skipped, the leaf
+	// certificate's SHA-256 must match one of the hashes and its validity
+	// period must be shorter than MaxCertificateValidity.
+	ServerCertificateHashes [][]byte
+
+	// ClientSessionCache keeps TLS session tickets, so later connections to
+	// a server resume the session. Share one cache between clients.
+	ClientSessionCache tls.ClientSessionCache
+
+	// Enable0RTT sends the CONNECT request as 0-RTT data when a session
+	// ticket of the server is cached. 0-RTT data can be replayed, servers
+	// may refuse it with 425 (Too Early), the request is then repeated after
+	// the handshake. Requires ClientSessionCache.
+	Enable0RTT bool
+
 	Path string
 
 	HandshakeIdleTimeout time.Duration
@@ -33,27 +57,41 @@ type ClientConfig struct {
 	MaxIdleTimeout time.Duration
 
 	KeepAlive bool
-}
 
-type WebTransportClient struct {
-	ClientConfig
-	connected bool
-	sessionId uint64
+	// AcceptQueueSize bounds the incoming streams waiting for
+	// AcceptStream/AcceptUniStream. Further streams are rejected. Defaults to
+	// DefaultAcceptQueueSize.
+	AcceptQueueSize int
 
-	Stream chan quic.Stream
+	// StreamHeaderTimeout bounds reading the stream type and session ID of
+	// incoming streams, slower streams are cancelled. Defaults to
+	// DefaultStreamHeaderTimeout.
+	StreamHeaderTimeout time.Duration
 
-	// Incoming unidirectional HTTP/3 streams (e.g. WebTransport)
-	ReceiveStream chan quic.ReceiveStream
+	// LazyStreamHeader defers the header of locally opened streams to the
+	// first Write or Flush, so it does not go out in a packet of its own.
+	LazyStreamHeader bool
 
-	OnMessage func([]byte)
+	// OnMessage receives datagrams instead of ReceiveDatagram. It is set
+	// before Connect, so no datagram is missed.
+	OnMessage func(message []byte)
 
+	// OnClose is called once when the session is closed.
 	OnClose func()
+}
 
-	session quic.Session
+type WebTransportClient struct {
+	ClientConfig
+	*webtransportSession
 
-	connectStream quic.Stream
+	// serializes Connect, the session fields are written before the session
+	// is open and only read after
+	connectMutex sync.Mutex
 
-	settingsStream quic.ReceiveStream
+	// the QUIC connection the session was opened over
+	conn *clientConn
+	// endpoint is the address conn was dialed to, guarded by the state mutex
+	endpoint string
 }
 
 func CreateWebTransportClient(config ClientConfig) *WebTransportClient {
@@ -64,342 +102,176 @@ func CreateWebTransportClient(config ClientConfig) *WebTransportClient {
 	if config.MaxIdleTimeout <= 0 {
 		config.MaxIdleTimeout = time.Duration(10 * time.Minute)
 	}
-
-	return &WebTransportClient{
-		ClientConfig:  config,
-		connected:     false,
-		sessionId:     0,
-		Stream:        make(chan quic.Stream),
-		ReceiveStream: make(chan quic.ReceiveStream),
-	}
-}
-
-func (client *WebTransportClient) Connect() error {
-	session, err := quic.DialAddr(
-		client.RemoteAddr,
-		&tls.Config{
-			Certificates:       client.Certificates,
-			InsecureSkipVerify: client.InsecureSkipVerify,
-			NextProtos:         []string{"h3", "h3-32", "h3-31", "h3-30", "h3-29"},
-		},
-		&quic.Config{
-			EnableDatagrams:      true,
-			HandshakeIdleTimeout: client.HandshakeIdleTimeout,
-			MaxIdleTimeout:       client.MaxIdleTimeout,
-			KeepAlive:            client.KeepAlive,
-		},
-	)
-	if err != nil {
-		return err
-	}
-
-	client.session = session
-
-	acceptUniStream, err := session.AcceptUniStream(context.Background())
-	if err != nil {
-		return err
-	}
-
-	buf := make([]byte, 1)
-	n, err := acceptUniStream.Read(buf)
-	if err != nil || n == 0 {
-		log.Printf("data stream err: %v", err)
-		return err
-	}
-
-	frame, err := h3.ParseNextFrame(acceptUniStream)
-	if err != nil {
-		log.Printf("request stream ParseNextFrame err: %v", err)
-		return err
-	}
-
-	settingsFrame, ok := frame.(*h3.SettingsFrame)
-	if !ok {
-		log.Println("server stream got not SettingsFrame")
-		return errors.New("server stream got not SettingsFrame")
-	}
-
-	client.settingsStream = acceptUniStream
-
-	// 判断 server 是否支持 webtransport
-	if settingsFrame.Other[H3_DATAGRAM_05] != 1 || settingsFrame.Other[ENABLE_WEBTRNASPORT] != 1 || settingsFrame.Other[ENABLE_CONNECT_PROTOCOL] != 1 {
-		log.Println("server not support webtransport")
-		return errors.New("server not support webtransport")
+	if config.AcceptQueueSize <= 0 {
+		config.AcceptQueueSize = DefaultAcceptQueueSize
 	}
-
-	openUniStream, err := session.OpenUniStreamSync(context.Background())
-	if err != nil {
-		log.Println("create settingStream failed")
-		return err
+	if config.StreamHeaderTimeout <= 0 {
+		config.StreamHeaderTimeout = DefaultStreamHeaderTimeout
 	}
 
-	// 发送Setting帧
-	sbuf := &bytes.Buffer{}
-	// stream type
-	quicvarint.Write(sbuf, 0)
-	(&h3.SettingsFrame{
-		Datagram: true,
-		Other: map[uint64]uint64{
-			uint64(H3_DATAGRAM_05):          uint64(1),
-			uint64(ENABLE_CONNECT_PROTOCOL): uint64(1),
-			uint64(ENABLE_WEBTRNASPORT):     uint64(1),
-		},
-	}).Write(sbuf)
-	openUniStream.Write(sbuf.Bytes())
-
-	requestStream, err := session.OpenStreamSync(context.Background())
-	if err != nil {
-		log.Println("create connectStream failed")
-		return err
+	client := &WebTransportClient{
+		ClientConfig:        config,
+		webtransportSession: newWebTransportSession(StateConnecting, config.AcceptQueueSize, &streamStats{}),
 	}
+	client.lazyStreamHeader = config.LazyStreamHeader
+	client.onMessage = config.OnMessage
+	client.onClose = config.OnClose
+	client.outer = client
+	return client
+}
 
-	client.connectStream = requestStream
-
-	requestWriter := h3.NewRequestWriter()
-
-	err = requestWriter.WriteRequest(requestStream, &http.Request{
-		Method: "CONNECT",
-		Proto:  "webtransport",
-		URL: &url.URL{
-			Path:   client.Path,
-			Scheme: "https",
-		},
-		Host:   client.RemoteAddr,
-		Header: http.Header{},
-		Body:   nil,
-	}, false)
-	if err != nil {
-		log.Println("request frame failed")
-		return err
-	}
+// Connect dials the server and establishes the session, failures are
+// returned as *ConnectError. Cancelling ctx aborts the QUIC handshake, the
+// SETTINGS exchange and the CONNECT request, Connect then returns ctx.Err()
+// wrapped in *ConnectError. A failed Connect may be retried, a client that is
+// open or closed cannot connect again.
+func (client *WebTransportClient) Connect(ctx context.Context) error {
+	return client.connect(ctx, nil)
+}
 
-	resFrame, err := h3.ParseNextFrame(requestStream)
-	if err != nil {
-		log.Println("parse response frame failed")
-		return err
+// connect opens the session on a connection of pool with a free slot, or
+// dials the endpoints in turn for a new connection.
+func (client *WebTransportClient) connect(ctx context.Context, pool *ClientPool) error {
+	client.connectMutex.Lock()
+	defer client.connectMutex.Unlock()
+	if state := client.state.get(); state != StateConnecting {
+		if state == StateOpen {
+			return &ConnectError{Err: ErrAlreadyConnected}
+		}
+		return &ConnectError{Err: client.state.err()}
 	}
 
-	hf, ok := resFrame.(*h3.HeadersFrame)
-	if !ok {
-		log.Println("expected first frame to be a HEADERS frame")
-		return errors.New("server stream got not HeadersFrame")
+	var err error
+	if conn := pool.reserve(); conn != nil {
+		err = conn.connect(ctx, client)
+	} else {
+		err = client.dial(ctx, pool)
 	}
-	headerBlock := make([]byte, hf.Length)
-	if _, err := io.ReadFull(requestStream, headerBlock); err != nil {
-		return err
-	}
-	decoder := qpack.NewDecoder(nil)
-	hfs, err := decoder.DecodeFull(headerBlock)
-	if err != nil {
-		return err
-	}
-
-	res, err := h3.ResponseFromHeaders(hfs)
 	if err != nil {
-		log.Println("parse response failed")
 		return err
 	}
 
-	if res.StatusCode != 200 {
-		log.Println("request connect failed")
-		return errors.New("request connect failed")
+	if !client.state.open() {
+		// closed while connecting
+		client.connectStream.CancelRead(H3_NO_ERROR)
+		client.connectStream.Close()
+		client.conn.release(client, H3_NO_ERROR, "")
+		return &ConnectError{Err: client.state.err()}
 	}
-
-	client.connected = true
-	client.handleStream()
+	client.state.mutex.Lock()
+	client.endpoint = client.conn.endpoint
+	client.state.mutex.Unlock()
+	go client.readConnectStream()
 
 	return nil
-
 }
 
-func (client *WebTransportClient) handleStream() {
-	go func() {
-		for {
-			stream, err := client.session.AcceptUniStream(client.session.Context())
-			log.Printf("[AcceptUniStream]client accepted for streamId: %d", stream.StreamID())
-			if err != nil {
-				client.close()
-				return
-			}
-
-			if stream.StreamID() == client.settingsStream.StreamID() {
-				log.Printf("[AcceptUniStream]accepted settingsStream streamId: %d", stream.StreamID())
-				continue
-			}
-
-			go func(stream quic.ReceiveStream) {
-				br, ok := stream.(byteReader)
-				if !ok {
-					br = &byteReaderImpl{stream}
-				}
-				streamType, err := quicvarint.Read(br)
-				if err != nil {
-					return
-				}
-				sessionId, err := quicvarint.Read(br)
-				if err != nil {
-					return
-				}
-
-				if streamType == WebTransportUniStream {
-					log.Printf("[AcceptUniStream]receiveStream accepted streamId: %d, sessionId: %d", stream.StreamID(), sessionId)
-					client.ReceiveStream <- stream
-				}
-
-			}(stream)
+// dial tries the endpoints until a new connection is established and the
+// session is opened over it. The connection joins pool when set.
+func (client *WebTransportClient) dial(ctx context.Context, pool *ClientPool) error {
+	addrs := []string{client.RemoteAddr}
+	if client.Endpoints != nil {
+		addrs = client.Endpoints.candidates()
+	}
+	if len(addrs) == 0 {
+		return &ConnectError{Err: errors.New("no endpoints to connect to")}
+	}
+	var err error
+	for _, addr := range addrs {
+		early := client.Enable0RTT && client.ClientSessionCache != nil
+		var rtt time.Duration
+		rtt, err = client.dialAddr(ctx, pool, addr, early)
+		if early && errors.Is(err, quic.Err0RTTRejected) && ctx.Err() == nil {
+			// the server did not accept the ticket, a full handshake follows
+			rtt, err = client.dialAddr(ctx, pool, addr, false)
 		}
-	}()
-
-	go func() {
-		for {
-			stream, err := client.session.AcceptStream(client.session.Context())
-			log.Printf("[AcceptStream]client accepted for streamId: %d", stream.StreamID())
-			if err != nil {
-				client.close()
-				return
-			}
-
-			if stream.StreamID() == client.connectStream.StreamID() {
-				log.Printf("[AcceptUniStream]accepted connectStream streamId: %d", stream.StreamID())
-				continue
+		if err == nil {
+			if client.Endpoints != nil {
+				client.Endpoints.succeeded(addr, rtt)
 			}
-
-			go func(stream quic.Stream) {
-				br, ok := stream.(byteReader)
-				if !ok {
-					br = &byteReaderImpl{stream}
-				}
-				streamType, err := quicvarint.Read(br)
-				if err != nil {
-					return
-				}
-				sessionId, err := quicvarint.Read(br)
-				if err != nil {
-					return
-				}
-
-				if streamType == WebTransportStream {
-					log.Printf("[AcceptStream]stream accepted streamId: %d, sessionId: %d", stream.StreamID(), sessionId)
-					client.Stream <- stream
-				}
-			}(stream)
+			return nil
 		}
-	}()
-
-	go func() {
-		for {
-			msg, err := client.session.ReceiveMessage()
-			if err != nil {
-				client.close()
-				return
-			}
-			log.Printf("[webtransport_client]received message: %v", string(msg))
-
-			if len(msg) > 0 {
-				// TODO https://datatracker.ietf.org/doc/draft-ietf-webtrans-http3/ Session Termination 结束 session
-				if client.OnMessage != nil {
-					client.OnMessage(msg)
-				}
-			}
+		if ctx.Err() != nil {
+			return err
 		}
-	}()
-
-	go func() {
-		for {
-			buf := make([]byte, 1024)
-			n, err := client.connectStream.Read(buf)
-			if n > 0 {
-				log.Printf("[webtransport_client]connect stream accepted data, but ignore,read message: (n: %d)%v", n, string(buf))
-			}
-
-			if err == io.EOF {
-				client.close()
-				return
-			}
-			if err != nil {
-				client.close()
-				return
-			}
+		if client.Endpoints != nil {
+			log.Printf("[webtransport_client]connect to %s failed: %v", addr, err)
+			client.Endpoints.failed(addr)
 		}
-	}()
-}
-
-func (client *WebTransportClient) CreateStream() (quic.Stream, error) {
-	if client.connected {
-		stream, err := client.session.OpenStream()
-		if err != nil {
-			return nil, err
-		}
-
-		buf := &bytes.Buffer{}
-		quicvarint.Write(buf, WebTransportStream)
-		quicvarint.Write(buf, client.sessionId)
-
-		stream.Write(buf.Bytes())
-
-		return stream, nil
 	}
-
-	return nil, errors.New("client not connect")
+	return err
 }
 
-func (client *WebTransportClient) CreateUniStream() (quic.SendStream, error) {
-	if client.connected {
-		stream, err := client.session.OpenUniStream()
-		if err != nil {
-			return nil, err
-		}
-
-		buf := &bytes.Buffer{}
-		quicvarint.Write(buf, WebTransportUniStream)
-		quicvarint.Write(buf, client.sessionId)
-
-		stream.Write(buf.Bytes())
-
-		return stream, nil
+// dialAddr opens the session over a new connection to addr, it returns the
+// handshake time.
+func (client *WebTransportClient) dialAddr(ctx context.Context, pool *ClientPool, addr string, early bool) (time.Duration, error) {
+	conn, err := dialClientConn(ctx, &client.ClientConfig, addr, pool == nil, early)
+	if err != nil {
+		return 0, err
 	}
-
-	return nil, errors.New("client not connect")
-}
-
-func (client *WebTransportClient) SendMessage(message []byte) error {
-	if client.connected {
-		buf := &bytes.Buffer{}
-		quicvarint.Write(buf, client.sessionId)
-		buf.Write(message)
-		return client.session.SendMessage(buf.Bytes())
+	if pool != nil {
+		conn.limit(pool.MaxSessionsPerConnection)
+	}
+	// take the slot before other sessions of the pool can see the connection
+	if !conn.reserve() {
+		return 0, &ConnectError{Err: ErrSessionClosed}
+	}
+	if pool != nil {
+		pool.add(conn)
 	}
-	return errors.New("client not connect")
+	if err := conn.connect(ctx, client); err != nil {
+		return 0, err
+	}
+	return conn.handshakeRTT(ctx), nil
 }
 
-func (client *WebTransportClient) close() {
+// Endpoint returns the address of the server the session is connected to,
+// empty when Connect did not succeed.
+func (client *WebTransportClient) Endpoint() string {
+	client.state.mutex.Lock()
+	defer client.state.mutex.Unlock()
+	return client.endpoint
+}
 
-	if client.session == nil {
-		return
+func (c *ClientConfig) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		Certificates:       c.Certificates,
+		RootCAs:            c.RootCAs,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		NextProtos:         nextProtos,
+		ClientSessionCache: c.ClientSessionCache,
 	}
-
-	client.session = nil
-
-	close(client.Stream)
-	close(client.ReceiveStream)
-
-	client.connectStream = nil
-	client.settingsStream = nil
-	client.ReceiveStream = nil
-	client.Stream = nil
-	client.connected = false
-
-	if client.OnClose != nil {
-		client.OnClose()
+	if len(c.ServerCertificateHashes) > 0 {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyCertificateHashes(c.ServerCertificateHashes)
 	}
+	return config
 }
 
-func (client *WebTransportClient) Close(code quic.ApplicationErrorCode, message string) error {
-	if !client.connected {
-		client.connectStream.Close()
-		err := client.session.CloseWithError(code, message)
-		client.close()
-		return err
+// verifyCertificateHashes checks the leaf certificate against pinned hashes,
+// see https://w3c.github.io/webtransport/#verify-a-certificate-hash
+func verifyCertificateHashes(hashes [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if cert.NotAfter.Sub(cert.NotBefore) >= MaxCertificateValidity {
+			return fmt.Errorf("certificate validity exceeds %s", MaxCertificateValidity)
+		}
+		now := time.Now()
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return errors.New("certificate is expired or not yet valid")
+		}
+		hash := CertificateHash(rawCerts[0])
+		for _, pinned := range hashes {
+			if bytes.Equal(hash, pinned) {
+				return nil
+			}
+		}
+		return errors.New("certificate hash does not match any of ServerCertificateHashes")
 	}
-	return nil
 }
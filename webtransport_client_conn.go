@@ -0,0 +1,520 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"git.baijiashilian.com/shared/brtc/webtransport-go/h3"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"github.com/marten-seemann/qpack"
+)
+
+// clientConn is a QUIC connection of the client side. It exchanges SETTINGS
+// once and dispatches streams and datagrams to the sessions opened over it.
+type clientConn struct {
+	session        quic.Session
+	endpoint       string
+	settingsStream quic.ReceiveStream
+
+	streamHeaderTimeout time.Duration
+	// maxSessions is the number of sessions opened over the connection, at
+	// most what the server advertised
+	maxSessions int
+	// closeWhenIdle closes the QUIC connection with its last session, it is
+	// unset for pooled connections
+	closeWhenIdle bool
+	// verifySettings is set when sessions were opened with the remembered
+	// SETTINGS of the server before its SETTINGS arrived
+	verifySettings bool
+	// handshakeDone is closed once the handshake ended, handshakeTime is
+	// then the time it took since the dial started
+	handshakeDone chan struct{}
+	handshakeTime time.Duration
+
+	stats streamStats
+
+	mutex   sync.Mutex
+	clients map[uint64]*WebTransportClient
+	// sessions counts the registered clients and the reserved slots
+	sessions int
+	closed   bool
+}
+
+// rememberedSettings holds the session limit last advertised by each server
+// address. With 0-RTT, sessions are opened with them before the server's
+// SETTINGS arrive, see RFC 9114 section 7.2.4.2.
+var rememberedSettings sync.Map
+
+// dialClientConn dials addr and exchanges SETTINGS. With early set the
+// connection attempts 0-RTT.
+func dialClientConn(ctx context.Context, config *ClientConfig, addr string, closeWhenIdle bool, early bool) (*clientConn, error) {
+	dialer := config.Dialer
+	if dialer == nil {
+		dialer = &Dialer{}
+	}
+	start := time.Now()
+	session, err := dialer.dial(
+		ctx,
+		addr,
+		config.tlsConfig(),
+		&quic.Config{
+			EnableDatagrams:      true,
+			HandshakeIdleTimeout: config.HandshakeIdleTimeout,
+			MaxIdleTimeout:       config.MaxIdleTimeout,
+			KeepAlive:            config.KeepAlive,
+		},
+		early,
+	)
+	if err != nil {
+		return nil, &ConnectError{Err: err}
+	}
+
+	c := &clientConn{
+		session:             session,
+		endpoint:            addr,
+		streamHeaderTimeout: config.StreamHeaderTimeout,
+		closeWhenIdle:       closeWhenIdle,
+		handshakeDone:       make(chan struct{}),
+		clients:             make(map[uint64]*WebTransportClient),
+	}
+	// an early session is returned before the server answered
+	go c.measureHandshake(start)
+	if maxSessions, ok := rememberedSettings.Load(addr); ok && early {
+		// the CONNECT request may go out as 0-RTT data
+		c.maxSessions = maxSessions.(int)
+		c.verifySettings = true
+		err = runContext(ctx, func() {
+			_ = session.CloseWithError(H3_NO_ERROR, "")
+		}, c.sendSettings)
+	} else {
+		err = runContext(ctx, func() {
+			_ = session.CloseWithError(H3_NO_ERROR, "")
+		}, func() error {
+			if err := c.readSettings(); err != nil {
+				return err
+			}
+			return c.sendSettings()
+		})
+	}
+	if err != nil {
+		_ = session.CloseWithError(H3_NO_ERROR, "")
+		var connectErr *ConnectError
+		if errors.As(err, &connectErr) {
+			return nil, err
+		}
+		return nil, &ConnectError{Err: err}
+	}
+
+	go c.serve()
+	return c, nil
+}
+
+// measureHandshake records the handshake time once the handshake ends.
+func (c *clientConn) measureHandshake(start time.Time) {
+	defer close(c.handshakeDone)
+	if earlySession, ok := c.session.(quic.EarlySession); ok {
+		select {
+		case <-earlySession.HandshakeComplete().Done():
+		case <-c.session.Context().Done():
+			return
+		}
+	}
+	c.handshakeTime = time.Since(start)
+}
+
+// handshakeRTT waits for the handshake and returns the time it took, zero
+// when the connection closed first.
+func (c *clientConn) handshakeRTT(ctx context.Context) time.Duration {
+	select {
+	case <-c.handshakeDone:
+		return c.handshakeTime
+	case <-ctx.Done():
+		return 0
+	}
+}
+
+// runContext runs f and calls abort when ctx is done before f returns. It
+// returns ctx.Err() once ctx is done, f may have failed because of abort.
+func runContext(ctx context.Context, abort func(), f func() error) error {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			abort()
+		case <-done:
+		}
+	}()
+
+	err := f()
+	close(done)
+	<-stopped
+	// abort may have run right after f returned
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// readSettings reads the server's SETTINGS and remembers them for 0-RTT.
+func (c *clientConn) readSettings() error {
+	acceptUniStream, err := c.session.AcceptUniStream(context.Background())
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1)
+	n, err := acceptUniStream.Read(buf)
+	if err != nil || n == 0 {
+		log.Printf("data stream err: %v", err)
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	frame, err := h3.ParseNextFrame(acceptUniStream)
+	if err != nil {
+		log.Printf("request stream ParseNextFrame err: %v", err)
+		return err
+	}
+
+	settingsFrame, ok := frame.(*h3.SettingsFrame)
+	if !ok {
+		log.Println("server stream got not SettingsFrame")
+		return errors.New("server stream got not SettingsFrame")
+	}
+
+	c.settingsStream = acceptUniStream
+
+	// 判断 server 是否支持 webtransport
+	if settingsFrame.Other[H3_DATAGRAM_05] != 1 || settingsFrame.Other[ENABLE_WEBTRNASPORT] != 1 || settingsFrame.Other[ENABLE_CONNECT_PROTOCOL] != 1 {
+		log.Println("server not support webtransport")
+		return ErrWebTransportUnsupported
+	}
+	// servers that do not advertise a limit take one session per connection
+	maxSessions := 1
+	if n := settingsFrame.Other[WEBTRANSPORT_MAX_SESSIONS]; n > 1 {
+		maxSessions = int(n)
+	}
+	rememberedSettings.Store(c.endpoint, maxSessions)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.verifySettings && maxSessions < c.maxSessions {
+		log.Printf("[webtransport_client]server %s lowered its session limit to %d", c.endpoint, maxSessions)
+	}
+	c.maxSessions = maxSessions
+	return nil
+}
+
+// sendSettings opens our control stream with SETTINGS.
+func (c *clientConn) sendSettings() error {
+	openUniStream, err := c.session.OpenUniStreamSync(context.Background())
+	if err != nil {
+		log.Println("create settingStream failed")
+		return err
+	}
+
+	// 发送Setting帧
+	sbuf := &bytes.Buffer{}
+	// stream type
+	quicvarint.Write(sbuf, 0)
+	(&h3.SettingsFrame{
+		Datagram: true,
+		Other: map[uint64]uint64{
+			uint64(H3_DATAGRAM_05):          uint64(1),
+			uint64(ENABLE_CONNECT_PROTOCOL): uint64(1),
+			uint64(ENABLE_WEBTRNASPORT):     uint64(1),
+		},
+	}).Write(sbuf)
+	_, err = openUniStream.Write(sbuf.Bytes())
+	return err
+}
+
+// limit lowers the number of sessions opened over the connection.
+func (c *clientConn) limit(maxSessions int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if maxSessions > 0 && maxSessions < c.maxSessions {
+		c.maxSessions = maxSessions
+	}
+}
+
+// reserve takes a session slot, it fails when the connection is full or closed.
+func (c *clientConn) reserve() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed || c.sessions >= c.maxSessions {
+		return false
+	}
+	c.sessions++
+	return true
+}
+
+// connect sends the CONNECT request of client on a reserved slot. A request
+// the server refuses as 0-RTT data with 425 is repeated once the handshake is
+// complete. On error the slot is released.
+func (c *clientConn) connect(ctx context.Context, client *WebTransportClient) error {
+	err := c.connectOnce(ctx, client)
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) && connectErr.StatusCode == http.StatusTooEarly {
+		if early, ok := c.session.(quic.EarlySession); ok {
+			select {
+			case <-early.HandshakeComplete().Done():
+				err = c.connectOnce(ctx, client)
+			case <-ctx.Done():
+				err = &ConnectError{Err: ctx.Err()}
+			}
+		}
+	}
+	if err != nil {
+		c.release(nil, H3_NO_ERROR, "")
+	}
+	return err
+}
+
+// connectOnce registers client before the request, so streams the server
+// opens right after its response are not lost. The slot is kept on error.
+func (c *clientConn) connectOnce(ctx context.Context, client *WebTransportClient) error {
+	requestStream, err := c.session.OpenStreamSync(ctx)
+	if err != nil {
+		log.Println("create connectStream failed")
+		return &ConnectError{Err: err}
+	}
+
+	client.session = c.session
+	client.conn = c
+	client.connectStream = requestStream
+	client.sessionId = uint64(requestStream.StreamID())
+	client.stats = &c.stats
+	client.release = func(code quic.ApplicationErrorCode, message string) error {
+		return c.release(client, code, message)
+	}
+	c.mutex.Lock()
+	c.clients[client.sessionId] = client
+	c.mutex.Unlock()
+
+	err = runContext(ctx, func() {
+		requestStream.CancelRead(H3_REQUEST_CANCELLED)
+		requestStream.CancelWrite(H3_REQUEST_CANCELLED)
+	}, func() error {
+		return c.request(client, requestStream)
+	})
+	if err != nil {
+		rejectStream(requestStream, H3_REQUEST_CANCELLED)
+		c.mutex.Lock()
+		delete(c.clients, client.sessionId)
+		c.mutex.Unlock()
+		var connectErr *ConnectError
+		if errors.As(err, &connectErr) {
+			return err
+		}
+		return &ConnectError{Err: err}
+	}
+	return nil
+}
+
+// request writes the CONNECT request and reads the response.
+func (c *clientConn) request(client *WebTransportClient, requestStream quic.Stream) error {
+	requestWriter := h3.NewRequestWriter()
+
+	err := requestWriter.WriteRequest(requestStream, &http.Request{
+		Method: "CONNECT",
+		Proto:  "webtransport",
+		URL: &url.URL{
+			Path:   client.Path,
+			Scheme: "https",
+		},
+		Host:   c.endpoint,
+		Header: http.Header{},
+		Body:   nil,
+	}, false)
+	if err != nil {
+		log.Println("request frame failed")
+		return err
+	}
+
+	resFrame, err := h3.ParseNextFrame(requestStream)
+	if err != nil {
+		log.Println("parse response frame failed")
+		return err
+	}
+
+	hf, ok := resFrame.(*h3.HeadersFrame)
+	if !ok {
+		log.Println("expected first frame to be a HEADERS frame")
+		return errors.New("server stream got not HeadersFrame")
+	}
+	headerBlock := make([]byte, hf.Length)
+	if _, err := io.ReadFull(requestStream, headerBlock); err != nil {
+		return err
+	}
+	decoder := qpack.NewDecoder(nil)
+	hfs, err := decoder.DecodeFull(headerBlock)
+	if err != nil {
+		return err
+	}
+
+	res, err := h3.ResponseFromHeaders(hfs)
+	if err != nil {
+		log.Println("parse response failed")
+		return err
+	}
+
+	if res.StatusCode != 200 {
+		log.Println("request connect failed")
+		return &ConnectError{StatusCode: res.StatusCode}
+	}
+	return nil
+}
+
+// release gives up the slot of client, or a reserved slot when client is
+// nil. The QUIC connection is closed with code when it was the last session
+// of a connection that is not pooled.
+func (c *clientConn) release(client *WebTransportClient, code quic.ApplicationErrorCode, message string) error {
+	c.mutex.Lock()
+	if client != nil {
+		if c.clients[client.sessionId] != client {
+			c.mutex.Unlock()
+			return nil
+		}
+		delete(c.clients, client.sessionId)
+	}
+	c.sessions--
+	idle := c.sessions == 0 && c.closeWhenIdle
+	c.mutex.Unlock()
+
+	if idle {
+		return c.session.CloseWithError(code, message)
+	}
+	return nil
+}
+
+func (c *clientConn) lookup(sessionId uint64) *WebTransportClient {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.clients[sessionId]
+}
+
+// serve dispatches until the QUIC connection is closed.
+func (c *clientConn) serve() {
+	go func() {
+		if c.verifySettings {
+			// the control stream is the first stream the server opens
+			if err := c.readSettings(); err != nil {
+				log.Printf("[webtransport_client]server %s SETTINGS: %v", c.endpoint, err)
+				rememberedSettings.Delete(c.endpoint)
+				_ = c.session.CloseWithError(H3_SETTINGS_ERROR, err.Error())
+				return
+			}
+		}
+		c.acceptUniStreams()
+	}()
+	go c.receiveDatagrams()
+	err := c.acceptStreams()
+	c.closeAll(sessionError(err))
+}
+
+func (c *clientConn) acceptUniStreams() {
+	for {
+		stream, err := c.session.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		log.Printf("[AcceptUniStream]client accepted for streamId: %d", stream.StreamID())
+
+		if stream.StreamID() == c.settingsStream.StreamID() {
+			log.Printf("[AcceptUniStream]accepted settingsStream streamId: %d", stream.StreamID())
+			continue
+		}
+
+		go func(stream quic.ReceiveStream) {
+			sessionId, ok := readStreamHeader(stream, WebTransportUniStream, c.streamHeaderTimeout, &c.stats)
+			if !ok {
+				return
+			}
+			client := c.lookup(sessionId)
+			if client == nil {
+				log.Printf("[AcceptUniStream]reject streamId: %d of unknown session %d", stream.StreamID(), sessionId)
+				rejectStream(stream, WEBTRANSPORT_BUFFERED_STREAM_REJECTED)
+				return
+			}
+			client.handleUniStream(stream)
+		}(stream)
+	}
+}
+
+func (c *clientConn) acceptStreams() error {
+	for {
+		stream, err := c.session.AcceptStream(context.Background())
+		if err != nil {
+			return err
+		}
+		log.Printf("[AcceptStream]client accepted for streamId: %d", stream.StreamID())
+
+		go func(stream quic.Stream) {
+			sessionId, ok := readStreamHeader(stream, WebTransportStream, c.streamHeaderTimeout, &c.stats)
+			if !ok {
+				return
+			}
+			client := c.lookup(sessionId)
+			if client == nil {
+				log.Printf("[AcceptStream]reject streamId: %d of unknown session %d", stream.StreamID(), sessionId)
+				rejectStream(stream, WEBTRANSPORT_BUFFERED_STREAM_REJECTED)
+				return
+			}
+			client.handleStream(stream)
+		}(stream)
+	}
+}
+
+func (c *clientConn) receiveDatagrams() {
+	for {
+		msg, err := c.session.ReceiveMessage()
+		if err != nil {
+			return
+		}
+
+		// TODO https://datatracker.ietf.org/doc/draft-ietf-webtrans-http3/ Session Termination 结束 session
+		sessionId, payload, err := parseDatagram(msg)
+		if err != nil {
+			log.Printf("[webtransport_client]ReceiveMessage format error, ignore it")
+			continue
+		}
+		if client := c.lookup(sessionId); client != nil {
+			client.handleDatagram(payload)
+		}
+	}
+}
+
+// closeAll closes every session once the QUIC connection is gone.
+func (c *clientConn) closeAll(cause *SessionError) {
+	c.mutex.Lock()
+	c.closed = true
+	clients := make([]*WebTransportClient, 0, len(c.clients))
+	for _, client := range c.clients {
+		clients = append(clients, client)
+	}
+	c.mutex.Unlock()
+
+	for _, client := range clients {
+		client.close(cause)
+	}
+}
+
+// isClosed reports whether the QUIC connection is gone.
+func (c *clientConn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
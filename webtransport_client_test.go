@@ -0,0 +1,39 @@
+package webtransport
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestEndpointAfterFailedConnect closes a client whose Connect failed, the
+// endpoint tried last is not reported.
+func TestEndpointAfterFailedConnect(t *testing.T) {
+	client := CreateWebTransportClient(testClientConfig("127.0.0.1:1"))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := client.Connect(ctx); err == nil {
+		t.Fatal("Connect to a closed port succeeded")
+	}
+	if endpoint := client.Endpoint(); endpoint != "" {
+		t.Fatalf("Endpoint = %q while connecting", endpoint)
+	}
+	client.Close(H3_NO_ERROR, "")
+	if endpoint := client.Endpoint(); endpoint != "" {
+		t.Fatalf("Endpoint = %q after Close", endpoint)
+	}
+}
+
+func TestEndpointAfterConnect(t *testing.T) {
+	_, addr := startTestServer(t, ServerConfig{}, nil)
+	client := CreateWebTransportClient(testClientConfig(addr))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(H3_NO_ERROR, "")
+	if endpoint := client.Endpoint(); endpoint != addr {
+		t.Fatalf("Endpoint = %q, want %q", endpoint, addr)
+	}
+}
@@ -0,0 +1,427 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.baijiashilian.com/shared/brtc/webtransport-go/h3"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"github.com/marten-seemann/qpack"
+)
+
+// HTTP/3 HEADERS frame type, the first varint of a request stream.
+const headersFrameType = 0x1
+
+// serverConn dispatches the streams and datagrams of one QUIC connection to
+// its WebTransport sessions. Streams and datagrams may arrive before the
+// CONNECT request of their session was handled, they are buffered per
+// connection until the session is registered or they expire.
+type serverConn struct {
+	server  *WebTransportServer
+	session quic.Session
+	stats   streamStats
+	// listener counts the sessions of the listener the connection came from
+	listener *listenerStats
+
+	mutex      sync.Mutex
+	transports map[uint64]*WebTransport
+	// sessions counts the registered sessions and the slots taken by
+	// CONNECT requests being answered
+	sessions         int
+	pending          []*pendingItem
+	pendingStreams   int
+	pendingDatagrams int
+}
+
+// pendingItem is a stream or datagram for a session that is not established yet.
+type pendingItem struct {
+	sessionId uint64
+	stream    quic.ReceiveStream
+	datagram  []byte
+	timer     *time.Timer
+}
+
+func newServerConn(server *WebTransportServer, session quic.Session, listener *listenerStats) *serverConn {
+	return &serverConn{
+		server:     server,
+		session:    session,
+		listener:   listener,
+		transports: make(map[uint64]*WebTransport),
+	}
+}
+
+// serve dispatches until the QUIC connection is closed.
+func (c *serverConn) serve() {
+	str, err := c.session.OpenUniStream()
+	if err != nil {
+		return
+	}
+	// 发送Setting帧
+	buf := &bytes.Buffer{}
+	// stream type
+	quicvarint.Write(buf, controlStreamType)
+	(&h3.SettingsFrame{
+		Datagram: true,
+		Other: map[uint64]uint64{
+			uint64(H3_DATAGRAM_05):            uint64(1),
+			uint64(ENABLE_CONNECT_PROTOCOL):   uint64(1),
+			uint64(ENABLE_WEBTRNASPORT):       uint64(1),
+			uint64(WEBTRANSPORT_MAX_SESSIONS): uint64(c.server.MaxSessionsPerConnection),
+		},
+	}).Write(buf)
+	if _, err := str.Write(buf.Bytes()); err != nil {
+		return
+	}
+
+	go c.acceptUniStreams()
+	go c.receiveDatagrams()
+	err = c.acceptStreams()
+	c.closeAll(sessionError(err))
+}
+
+func (c *serverConn) acceptStreams() error {
+	for {
+		stream, err := c.session.AcceptStream(context.Background())
+		if err != nil {
+			log.Printf("accept stream err: %v", err)
+			return err
+		}
+		go c.handleStream(stream)
+	}
+}
+
+// handleStream tells WebTransport streams from CONNECT requests by their first varint.
+func (c *serverConn) handleStream(stream quic.Stream) {
+	streamType, ok := readStreamType(stream, c.server.StreamHeaderTimeout, &c.stats)
+	if !ok {
+		return
+	}
+	switch streamType {
+	case WebTransportStream:
+		sessionId, ok := readSessionId(stream, &c.stats)
+		if !ok {
+			return
+		}
+		c.dispatch(&pendingItem{sessionId: sessionId, stream: stream})
+	case headersFrameType:
+		prefix := &bytes.Buffer{}
+		quicvarint.Write(prefix, streamType)
+		c.handleRequest(stream, io.MultiReader(prefix, stream))
+	default:
+		rejectStreamType(stream, streamType, &c.stats)
+	}
+}
+
+func (c *serverConn) acceptUniStreams() {
+	for {
+		stream, err := c.session.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func(stream quic.ReceiveStream) {
+			// 如果是 webtransport stream 则一定会读取到头数据，否则超时取消
+			sessionId, ok := readStreamHeader(stream, WebTransportUniStream, c.server.StreamHeaderTimeout, &c.stats)
+			if !ok {
+				return
+			}
+			c.dispatch(&pendingItem{sessionId: sessionId, stream: stream})
+		}(stream)
+	}
+}
+
+func (c *serverConn) receiveDatagrams() {
+	for {
+		msg, err := c.session.ReceiveMessage()
+		if err != nil {
+			return
+		}
+
+		// TODO https://datatracker.ietf.org/doc/draft-ietf-webtrans-http3/ Session Termination 结束 session
+		sessionId, payload, err := parseDatagram(msg)
+		if err != nil {
+			log.Printf("[webtransport]ReceiveMessage format error, ignore it")
+			continue
+		}
+		c.dispatch(&pendingItem{sessionId: sessionId, datagram: payload})
+	}
+}
+
+// isEarly reports whether the handshake of the connection is not complete,
+// data received until then may be 0-RTT data.
+func (c *serverConn) isEarly() bool {
+	early, ok := c.session.(quic.EarlySession)
+	if !ok {
+		return false
+	}
+	select {
+	case <-early.HandshakeComplete().Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// handleRequest answers a CONNECT request read from r and registers the new session.
+func (c *serverConn) handleRequest(requestStream quic.Stream, r io.Reader) {
+	s := c.server
+	sess := c.session
+	log.Printf("request stream accepted: %d", requestStream.StreamID())
+
+	ctx := requestStream.Context()
+	ctx = context.WithValue(ctx, http3.ServerContextKey, s)
+	ctx = context.WithValue(ctx, http.LocalAddrContextKey, sess.LocalAddr())
+	frame, err := h3.ParseNextFrame(r)
+	if err != nil {
+		log.Printf("request stream ParseNextFrame err: %v", err)
+		c.rejectRequest(requestStream, H3_REQUEST_INCOMPLETE)
+		return
+	}
+	hf, ok := frame.(*h3.HeadersFrame)
+	if !ok {
+		log.Println("request stream got not HeadersFrame")
+		c.rejectRequest(requestStream, H3_STREAM_CREATION_ERROR)
+		return
+	}
+	headerBlock := make([]byte, hf.Length)
+	if _, err := io.ReadFull(r, headerBlock); err != nil {
+		log.Printf("request stream read headerBlock err: %v", err)
+		c.rejectRequest(requestStream, H3_REQUEST_INCOMPLETE)
+		return
+	}
+	if err := requestStream.SetReadDeadline(time.Time{}); err != nil {
+		c.rejectRequest(requestStream, H3_REQUEST_INCOMPLETE)
+		return
+	}
+	decoder := qpack.NewDecoder(nil)
+	hfs, err := decoder.DecodeFull(headerBlock)
+	if err != nil {
+		log.Printf("request stream decoder err: %v", err)
+		c.rejectRequest(requestStream, H3_MESSAGE_ERROR)
+		return
+	}
+	req, err := h3.RequestFromHeaders(hfs)
+	if err != nil {
+		log.Printf("request stream RequestFromHeaders err: %v", err)
+		c.rejectRequest(requestStream, H3_MESSAGE_ERROR)
+		return
+	}
+
+	req.RemoteAddr = sess.RemoteAddr().String()
+	tlsState := sess.ConnectionState().TLS.ConnectionState
+	req.TLS = &tlsState
+	req = req.WithContext(ctx)
+	w := h3.NewResponseWriter(requestStream)
+	w.Header().Add("sec-webtransport-http3-draft", "draft02")
+
+	// https://datatracker.ietf.org/doc/draft-ietf-webtrans-http3/ 3.3.  Creating a New Session
+	if req.Method != "CONNECT" || req.Proto != "webtransport" || (req.URL.Path != s.Path && s.Path != "") {
+		w.WriteHeader(404)
+		w.Flush()
+		c.dropPending(uint64(requestStream.StreamID()))
+		return
+	}
+
+	if c.isEarly() && (s.Allow0RTT == nil || !s.Allow0RTT(req)) {
+		// 0-RTT data can be replayed, the client repeats the request after the handshake
+		w.WriteHeader(http.StatusTooEarly)
+		w.Flush()
+		c.dropPending(uint64(requestStream.StreamID()))
+		return
+	}
+
+	if !c.reserveSession() {
+		log.Printf("[webtransport]reject CONNECT, %d sessions on the connection", c.server.MaxSessionsPerConnection)
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Flush()
+		c.dropPending(uint64(requestStream.StreamID()))
+		return
+	}
+	w.WriteHeader(200)
+	w.Flush()
+
+	transport := createWebTransport(c, req, requestStream)
+	c.register(transport)
+
+	s.Webtransport <- transport
+}
+
+// rejectRequest resets a request stream that carries no valid request and
+// drops what was buffered for its session.
+func (c *serverConn) rejectRequest(requestStream quic.Stream, code quic.StreamErrorCode) {
+	rejectStream(requestStream, code)
+	c.dropPending(uint64(requestStream.StreamID()))
+}
+
+// dispatch hands a stream or datagram to its session, or buffers it when the
+// session is not established yet.
+func (c *serverConn) dispatch(item *pendingItem) {
+	c.mutex.Lock()
+	transport, ok := c.transports[item.sessionId]
+	if !ok {
+		ok = c.buffer(item)
+		c.mutex.Unlock()
+		if !ok {
+			c.drop(item)
+		}
+		return
+	}
+	c.mutex.Unlock()
+
+	transport.deliver(item)
+}
+
+// buffer keeps an item until its session is registered, it must be called with the mutex held.
+func (c *serverConn) buffer(item *pendingItem) bool {
+	if item.stream != nil {
+		if c.pendingStreams >= c.server.MaxPendingStreams {
+			return false
+		}
+		c.pendingStreams++
+	} else {
+		if c.pendingDatagrams >= c.server.MaxPendingDatagrams {
+			return false
+		}
+		c.pendingDatagrams++
+	}
+	c.pending = append(c.pending, item)
+	item.timer = time.AfterFunc(c.server.PendingTimeout, func() {
+		if c.removePending(item) {
+			c.drop(item)
+		}
+	})
+	return true
+}
+
+// removePending reports whether the item was still buffered.
+func (c *serverConn) removePending(item *pendingItem) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, pending := range c.pending {
+		if pending == item {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			c.forget(item)
+			return true
+		}
+	}
+	return false
+}
+
+// forget updates the pending counters, it must be called with the mutex held.
+func (c *serverConn) forget(item *pendingItem) {
+	if item.stream != nil {
+		c.pendingStreams--
+	} else {
+		c.pendingDatagrams--
+	}
+}
+
+// takePending removes and returns the buffered items of a session, it must be
+// called with the mutex held.
+func (c *serverConn) takePending(sessionId uint64) []*pendingItem {
+	var taken []*pendingItem
+	kept := c.pending[:0]
+	for _, item := range c.pending {
+		if item.sessionId != sessionId {
+			kept = append(kept, item)
+			continue
+		}
+		item.timer.Stop()
+		c.forget(item)
+		taken = append(taken, item)
+	}
+	for i := len(kept); i < len(c.pending); i++ {
+		c.pending[i] = nil
+	}
+	c.pending = kept
+	return taken
+}
+
+func (c *serverConn) drop(item *pendingItem) {
+	if item.stream == nil {
+		return
+	}
+	log.Printf("[webtransport]drop stream %d of unknown session %d", item.stream.StreamID(), item.sessionId)
+	atomic.AddUint64(&c.stats.pendingDropped, 1)
+	rejectStream(item.stream, WEBTRANSPORT_BUFFERED_STREAM_REJECTED)
+}
+
+func (c *serverConn) dropPending(sessionId uint64) {
+	c.mutex.Lock()
+	items := c.takePending(sessionId)
+	c.mutex.Unlock()
+
+	for _, item := range items {
+		c.drop(item)
+	}
+}
+
+// register makes a session reachable for dispatch and hands it what was
+// buffered for it. The CONNECT stream is read from then on, so a session
+// that ends right away is unregistered after it was registered.
+func (c *serverConn) register(transport *WebTransport) {
+	c.mutex.Lock()
+	c.transports[transport.sessionId] = transport
+	items := c.takePending(transport.sessionId)
+	atomic.AddUint64(&c.listener.sessions, 1)
+	atomic.AddInt64(&c.listener.activeSessions, 1)
+	c.server.track(transport)
+	c.mutex.Unlock()
+
+	for _, item := range items {
+		transport.deliver(item)
+	}
+	go transport.readConnectStream()
+}
+
+// reserveSession takes a slot for a session, it fails when the connection
+// has MaxSessionsPerConnection sessions. The slot is freed by unregister.
+func (c *serverConn) reserveSession() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.sessions >= c.server.MaxSessionsPerConnection {
+		return false
+	}
+	c.sessions++
+	return true
+}
+
+func (c *serverConn) unregister(transport *WebTransport) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.transports[transport.sessionId] == transport {
+		delete(c.transports, transport.sessionId)
+		c.sessions--
+		atomic.AddInt64(&c.listener.activeSessions, -1)
+		c.server.untrack(transport)
+	}
+}
+
+// closeAll closes every session once the QUIC connection is gone.
+func (c *serverConn) closeAll(cause *SessionError) {
+	c.mutex.Lock()
+	transports := make([]*WebTransport, 0, len(c.transports))
+	for _, transport := range c.transports {
+		transports = append(transports, transport)
+	}
+	for _, item := range c.pending {
+		item.timer.Stop()
+	}
+	c.pending = nil
+	c.pendingStreams = 0
+	c.pendingDatagrams = 0
+	c.mutex.Unlock()
+
+	for _, transport := range transports {
+		transport.close(cause)
+	}
+}
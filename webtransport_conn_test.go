@@ -0,0 +1,121 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"github.com/marten-seemann/qpack"
+)
+
+// fakeSession is the QUIC connection of a serverConn in unit tests.
+type fakeSession struct {
+	quic.Session
+}
+
+func (fakeSession) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4433}
+}
+
+// fakeStream records how it was cancelled.
+type fakeStream struct {
+	quic.Stream
+	id           quic.StreamID
+	cancelledBy  quic.StreamErrorCode
+	cancelled    bool
+	writeStopped bool
+}
+
+func (s *fakeStream) StreamID() quic.StreamID { return s.id }
+
+func (s *fakeStream) Context() context.Context { return context.Background() }
+
+func (s *fakeStream) SetReadDeadline(time.Time) error { return nil }
+
+func (s *fakeStream) CancelRead(code quic.StreamErrorCode) {
+	s.cancelledBy, s.cancelled = code, true
+}
+
+func (s *fakeStream) CancelWrite(quic.StreamErrorCode) { s.writeStopped = true }
+
+// headersFrame encodes an HTTP/3 HEADERS frame carrying headerBlock.
+func headersFrame(headerBlock []byte) []byte {
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, 0x1)
+	quicvarint.Write(buf, uint64(len(headerBlock)))
+	buf.Write(headerBlock)
+	return buf.Bytes()
+}
+
+// TestHandleRequestRejectsMalformedHeaders sends requests whose headers do not
+// decode, the request stream is reset and what was buffered for the session
+// is dropped.
+func TestHandleRequestRejectsMalformedHeaders(t *testing.T) {
+	noPseudoHeaders := &bytes.Buffer{}
+	encoder := qpack.NewEncoder(noPseudoHeaders)
+	if err := encoder.WriteField(qpack.HeaderField{Name: "foo", Value: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		headerBlock []byte
+	}{
+		{"invalid qpack", []byte{0xff, 0xff, 0xff, 0xff}},
+		{"no pseudo headers", noPseudoHeaders.Bytes()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := CreateWebTransportServer(ServerConfig{})
+			c := newServerConn(server, fakeSession{}, &listenerStats{})
+			const sessionId = 4
+			buffered := &fakeStream{id: 9}
+			c.dispatch(&pendingItem{sessionId: sessionId, stream: buffered})
+			c.dispatch(&pendingItem{sessionId: sessionId, datagram: []byte("early")})
+
+			requestStream := &fakeStream{id: sessionId}
+			c.handleRequest(requestStream, bytes.NewReader(headersFrame(test.headerBlock)))
+
+			if !requestStream.cancelled || requestStream.cancelledBy != H3_MESSAGE_ERROR || !requestStream.writeStopped {
+				t.Fatalf("request stream cancelled %v with %#x", requestStream.cancelled, requestStream.cancelledBy)
+			}
+			if buffered.cancelledBy != WEBTRANSPORT_BUFFERED_STREAM_REJECTED {
+				t.Fatalf("buffered stream cancelled with %#x", buffered.cancelledBy)
+			}
+			c.mutex.Lock()
+			pending := len(c.pending)
+			c.mutex.Unlock()
+			if pending != 0 {
+				t.Fatalf("%d items still pending", pending)
+			}
+		})
+	}
+}
+
+// TestDatagramRoundTrip encodes datagrams the way SendMessage does, with the
+// quarter stream ID, and parses them back.
+func TestDatagramRoundTrip(t *testing.T) {
+	for _, sessionId := range []uint64{0, 4, 8, 4 * 63, 4 * 64, 1 << 40, 4 * (1<<62 - 1)} {
+		buf := &bytes.Buffer{}
+		quicvarint.Write(buf, quarterStreamId(sessionId))
+		buf.WriteString("payload")
+		id, payload, err := parseDatagram(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != sessionId || string(payload) != "payload" {
+			t.Fatalf("session %d: parsed %d %q", sessionId, id, payload)
+		}
+	}
+
+	// session 8 is sent as quarter stream ID 2
+	if id, payload, err := parseDatagram([]byte{0x02, 'x'}); err != nil || id != 8 || string(payload) != "x" {
+		t.Fatalf("parsed %d %q %v", id, payload, err)
+	}
+	if _, _, err := parseDatagram(nil); err == nil {
+		t.Fatal("empty datagram parsed")
+	}
+}
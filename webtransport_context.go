@@ -0,0 +1,69 @@
+package webtransport
+
+import (
+	"context"
+)
+
+type (
+	sessionContextKey      struct{}
+	sessionStateContextKey struct{}
+)
+
+// sessionContext is cancelled when its session is closed. Values set on the
+// session are visible through it, so middleware and handlers can share them.
+type sessionContext struct {
+	context.Context
+	session *webtransportSession
+}
+
+func (c *sessionContext) Value(key interface{}) interface{} {
+	if key == (sessionContextKey{}) {
+		return c.session.outer
+	}
+	if key == (sessionStateContextKey{}) {
+		return c.session.state
+	}
+	if value, ok := c.session.values.Load(key); ok {
+		return value
+	}
+	return c.Context.Value(key)
+}
+
+// Context returns a context that is cancelled once the session is closed,
+// use Cause for the reason.
+func (s *webtransportSession) Context() context.Context {
+	return s.ctx
+}
+
+// SetValue attaches a value such as a user or room ID to the session, it is
+// returned by Value and by the session's Context.
+func (s *webtransportSession) SetValue(key, value interface{}) {
+	s.values.Store(key, value)
+}
+
+// Value returns the value attached with SetValue, or nil.
+func (s *webtransportSession) Value(key interface{}) interface{} {
+	value, _ := s.values.Load(key)
+	return value
+}
+
+// SessionFromContext returns the session of a context derived from
+// Session.Context.
+func SessionFromContext(ctx context.Context) (Session, bool) {
+	session, ok := ctx.Value(sessionContextKey{}).(Session)
+	return session, ok
+}
+
+// Cause returns the *SessionError the session of ctx was closed with, nil
+// while ctx is not done and ctx.Err() when ctx was cancelled on its own. It
+// stands in for context.Cause, which needs Go 1.20.
+func Cause(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	state, ok := ctx.Value(sessionStateContextKey{}).(*sessionState)
+	if !ok || state.get() != StateClosed {
+		return ctx.Err()
+	}
+	return state.err()
+}
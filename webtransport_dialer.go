@@ -0,0 +1,338 @@
+package webtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// DefaultAttemptDelay staggers the QUIC handshakes to the addresses of a
+// host when Dialer.AttemptDelay is not set, see RFC 8305 section 5.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// Dialer controls how WebTransportClient opens its QUIC connection. The zero
+// value dials from a new UDP socket with the default resolver.
+type Dialer struct {
+	// PacketConn is used instead of a new UDP socket. It is shared, so it is
+	// not closed with the session.
+	PacketConn net.PacketConn
+
+	// LocalAddr binds the new UDP socket, it is ignored with PacketConn.
+	// With an IP only the remote addresses of its family are dialed. With a
+	// port the raced attempts share one socket, otherwise every attempt binds
+	// a socket of its own.
+	LocalAddr *net.UDPAddr
+
+	// Resolver looks up the host of the remote address, net.DefaultResolver
+	// is used when nil.
+	Resolver *net.Resolver
+
+	// AttemptDelay staggers the handshakes raced to the IPv6 and IPv4
+	// addresses of a host, the first to succeed wins (happy eyeballs,
+	// RFC 8305). Defaults to DefaultAttemptDelay, a negative delay only
+	// dials the first address.
+	AttemptDelay time.Duration
+}
+
+// resolve looks up a host:port address. IPv6 and IPv4 addresses are
+// interleaved, IPv6 first, see RFC 8305 section 4.
+func (d *Dialer) resolve(ctx context.Context, addr string) ([]*net.UDPAddr, error) {
+	host, portName, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	port, err := strconv.Atoi(portName)
+	if err != nil {
+		if port, err = resolver.LookupPort(ctx, "udp", portName); err != nil {
+			return nil, err
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []*net.UDPAddr{{IP: ip, Port: port}}, nil
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return interleaveAddrs(ips, port), nil
+}
+
+// interleaveAddrs alternates IPv6 and IPv4 addresses, keeping the resolver's
+// order within each family.
+func interleaveAddrs(ips []net.IPAddr, port int) []*net.UDPAddr {
+	var v6, v4 []*net.UDPAddr
+	for _, ip := range ips {
+		udpAddr := &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+		if ip.IP.To4() != nil {
+			v4 = append(v4, udpAddr)
+		} else {
+			v6 = append(v6, udpAddr)
+		}
+	}
+	addrs := make([]*net.UDPAddr, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, v6[i])
+		}
+		if i < len(v4) {
+			addrs = append(addrs, v4[i])
+		}
+	}
+	return addrs
+}
+
+// rememberedAddrs holds the address each addr last connected to, an early
+// dial goes there directly instead of racing.
+var rememberedAddrs sync.Map
+
+// dial opens a QUIC connection to addr until ctx is done. The host of addr
+// is used for SNI unless tlsConf sets ServerName. With early set the
+// connection is returned as soon as 0-RTT data can be sent, it is a
+// quic.EarlySession. Raced attempts only win once their handshake completes,
+// so an early dial to an address that connected before skips the race to keep
+// 0-RTT. When that handshake fails the next dial races again.
+func (d *Dialer) dial(ctx context.Context, addr string, tlsConf *tls.Config, config *quic.Config, early bool) (quic.Session, error) {
+	remoteAddrs, err := d.resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.dialAddrs(ctx, remoteAddrs, addr, tlsConf, config, early)
+}
+
+// dialAddrs connects to one of the resolved remoteAddrs of addr.
+func (d *Dialer) dialAddrs(ctx context.Context, remoteAddrs []*net.UDPAddr, addr string, tlsConf *tls.Config, config *quic.Config, early bool) (quic.Session, error) {
+	if d.PacketConn == nil && d.LocalAddr != nil {
+		if remoteAddrs = sameFamily(remoteAddrs, d.LocalAddr.IP); len(remoteAddrs) == 0 {
+			return nil, fmt.Errorf("no address of %s matches the family of %s", addr, d.LocalAddr)
+		}
+		if d.LocalAddr.Port != 0 && len(remoteAddrs) > 1 {
+			return d.dialShared(ctx, remoteAddrs, addr, tlsConf, config, early)
+		}
+	}
+	if len(remoteAddrs) == 1 || d.AttemptDelay < 0 {
+		return d.dialAddr(ctx, remoteAddrs[0], addr, tlsConf, config, early)
+	}
+	if remembered := rememberedAddr(addr, remoteAddrs); early && remembered != nil {
+		session, err := d.dialAddr(ctx, remembered, addr, tlsConf, config, true)
+		if err == nil {
+			go forgetOnFailure(addr, session)
+			return session, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		rememberedAddrs.Delete(addr)
+	}
+	session, err := d.race(ctx, remoteAddrs, addr, tlsConf, config, early)
+	if err != nil {
+		return nil, err
+	}
+	if remoteAddr, ok := session.RemoteAddr().(*net.UDPAddr); ok {
+		rememberedAddrs.Store(addr, remoteAddr)
+	}
+	return session, nil
+}
+
+// dialShared dials remoteAddrs from one socket bound to LocalAddr, a fixed
+// port can only be bound once. The socket is closed with the session.
+func (d *Dialer) dialShared(ctx context.Context, remoteAddrs []*net.UDPAddr, addr string, tlsConf *tls.Config, config *quic.Config, early bool) (quic.Session, error) {
+	udpConn, err := net.ListenUDP("udp", d.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	shared := *d
+	shared.PacketConn = udpConn
+	session, err := shared.dialAddrs(ctx, remoteAddrs, addr, tlsConf, config, early)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	go func() {
+		<-session.Context().Done()
+		udpConn.Close()
+	}()
+	return session, nil
+}
+
+// sameFamily keeps the addresses of the family of a local IP, a socket bound
+// to an unspecified IP reaches both.
+func sameFamily(remoteAddrs []*net.UDPAddr, ip net.IP) []*net.UDPAddr {
+	if ip == nil || ip.IsUnspecified() {
+		return remoteAddrs
+	}
+	ipv4 := ip.To4() != nil
+	var filtered []*net.UDPAddr
+	for _, remoteAddr := range remoteAddrs {
+		if (remoteAddr.IP.To4() != nil) == ipv4 {
+			filtered = append(filtered, remoteAddr)
+		}
+	}
+	return filtered
+}
+
+// rememberedAddr returns the address addr last connected to when it is
+// still among remoteAddrs.
+func rememberedAddr(addr string, remoteAddrs []*net.UDPAddr) *net.UDPAddr {
+	value, ok := rememberedAddrs.Load(addr)
+	if !ok {
+		return nil
+	}
+	remembered := value.(*net.UDPAddr)
+	for _, remoteAddr := range remoteAddrs {
+		if remoteAddr.IP.Equal(remembered.IP) && remoteAddr.Port == remembered.Port {
+			return remoteAddr
+		}
+	}
+	return nil
+}
+
+// forgetOnFailure forgets the remembered address of addr when the early
+// session to it ends before its handshake completes.
+func forgetOnFailure(addr string, session quic.Session) {
+	earlySession, ok := session.(quic.EarlySession)
+	if !ok {
+		return
+	}
+	select {
+	case <-earlySession.HandshakeComplete().Done():
+	case <-session.Context().Done():
+		rememberedAddrs.Delete(addr)
+	}
+}
+
+type dialResult struct {
+	session quic.Session
+	err     error
+}
+
+// race starts a handshake to the next address every AttemptDelay, or as soon
+// as an attempt fails. The first connection to complete its handshake wins,
+// the others are closed.
+func (d *Dialer) race(ctx context.Context, remoteAddrs []*net.UDPAddr, host string, tlsConf *tls.Config, config *quic.Config, early bool) (quic.Session, error) {
+	delay := d.AttemptDelay
+	if delay == 0 {
+		delay = DefaultAttemptDelay
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(remoteAddrs))
+	next, running := 0, 0
+	var firstErr error
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for next < len(remoteAddrs) || running > 0 {
+		var start <-chan time.Time
+		if next < len(remoteAddrs) {
+			start = timer.C
+		}
+		select {
+		case <-start:
+			go func(remoteAddr *net.UDPAddr) {
+				// quic-go sets ServerName on the config it is given
+				session, err := d.dialAddr(ctx, remoteAddr, host, tlsConf.Clone(), config, early)
+				if err == nil && early {
+					// an early session is returned before the server answered
+					if err = waitHandshake(ctx, session); err != nil {
+						_ = session.CloseWithError(H3_NO_ERROR, "")
+					}
+				}
+				results <- dialResult{session: session, err: err}
+			}(remoteAddrs[next])
+			next++
+			running++
+			timer.Reset(delay)
+		case result := <-results:
+			running--
+			if result.err == nil {
+				cancel()
+				go closeLosers(results, running)
+				return result.session, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if next < len(remoteAddrs) {
+				// start the next attempt right away
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// waitHandshake blocks until the handshake of session completes.
+func waitHandshake(ctx context.Context, session quic.Session) error {
+	earlySession, ok := session.(quic.EarlySession)
+	if !ok {
+		return nil
+	}
+	select {
+	case <-earlySession.HandshakeComplete().Done():
+		return nil
+	case <-session.Context().Done():
+		return errors.New("connection closed during the handshake")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeLosers closes the connections of attempts still running when the race was won.
+func closeLosers(results <-chan dialResult, running int) {
+	for i := 0; i < running; i++ {
+		result := <-results
+		if result.err == nil {
+			_ = result.session.CloseWithError(H3_NO_ERROR, "")
+		}
+	}
+}
+
+// dialAddr opens a QUIC connection to one address of host.
+func (d *Dialer) dialAddr(ctx context.Context, remoteAddr *net.UDPAddr, host string, tlsConf *tls.Config, config *quic.Config, early bool) (quic.Session, error) {
+	if d.PacketConn != nil {
+		return dialContext(ctx, d.PacketConn, remoteAddr, host, tlsConf, config, early)
+	}
+
+	udpConn, err := net.ListenUDP("udp", d.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	session, err := dialContext(ctx, udpConn, remoteAddr, host, tlsConf, config, early)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	// the socket belongs to this connection only
+	go func() {
+		<-session.Context().Done()
+		udpConn.Close()
+	}()
+	return session, nil
+}
+
+func dialContext(ctx context.Context, pconn net.PacketConn, remoteAddr net.Addr, host string, tlsConf *tls.Config, config *quic.Config, early bool) (quic.Session, error) {
+	if early {
+		return quic.DialEarlyContext(ctx, pconn, remoteAddr, host, tlsConf, config)
+	}
+	return quic.DialContext(ctx, pconn, remoteAddr, host, tlsConf, config)
+}
@@ -0,0 +1,259 @@
+package webtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+func TestInterleaveAddrs(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  []string
+		want []string
+	}{
+		{"empty", nil, nil},
+		{"ipv4 only", []string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.1", "192.0.2.2"}},
+		{"ipv6 only", []string{"2001:db8::1", "2001:db8::2"}, []string{"2001:db8::1", "2001:db8::2"}},
+		{"ipv6 first", []string{"192.0.2.1", "2001:db8::1"}, []string{"2001:db8::1", "192.0.2.1"}},
+		{"alternating", []string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"},
+			[]string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}},
+		{"more ipv4", []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1"},
+			[]string{"2001:db8::1", "192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		{"ipv4-mapped is ipv4", []string{"::ffff:192.0.2.1", "2001:db8::1"}, []string{"2001:db8::1", "192.0.2.1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ips []net.IPAddr
+			for _, ip := range test.ips {
+				ips = append(ips, net.IPAddr{IP: net.ParseIP(ip)})
+			}
+			addrs := interleaveAddrs(ips, 443)
+			if len(addrs) != len(test.want) {
+				t.Fatalf("got %v, want %v", addrs, test.want)
+			}
+			for i, addr := range addrs {
+				if !addr.IP.Equal(net.ParseIP(test.want[i])) || addr.Port != 443 {
+					t.Fatalf("got %v, want %v", addrs, test.want)
+				}
+			}
+		})
+	}
+}
+
+// notifyCache signals put once a session ticket was stored.
+type notifyCache struct {
+	tls.ClientSessionCache
+	put chan struct{}
+}
+
+func (c *notifyCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.ClientSessionCache.Put(sessionKey, cs)
+	if cs != nil {
+		select {
+		case c.put <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// TestDialerRaceBlackHole races a first address that never answers against a
+// working loopback server, the server must win once AttemptDelay passes. With
+// a ticket cached, an early attempt to the first address must not win before
+// the server answered.
+func TestDialerRaceBlackHole(t *testing.T) {
+	for _, early := range []bool{false, true} {
+		t.Run(fmt.Sprintf("early=%v", early), func(t *testing.T) {
+			_, addr := startTestServer(t, ServerConfig{Enable0RTT: early}, nil)
+			working, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a bound socket nobody reads from drops every packet
+			blackHole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer blackHole.Close()
+
+			tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: nextProtos}
+			config := &quic.Config{EnableDatagrams: true, HandshakeIdleTimeout: 5 * time.Second}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			dialer := &Dialer{AttemptDelay: 100 * time.Millisecond}
+			if early {
+				cache := &notifyCache{ClientSessionCache: tls.NewLRUClientSessionCache(1), put: make(chan struct{}, 1)}
+				tlsConf.ClientSessionCache = cache
+				session, err := dialer.dialAddr(ctx, working, "localhost", tlsConf.Clone(), config, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case <-cache.put:
+				case <-ctx.Done():
+					t.Fatal("no session ticket")
+				}
+				session.CloseWithError(H3_NO_ERROR, "")
+			}
+
+			start := time.Now()
+			session, err := dialer.race(ctx,
+				[]*net.UDPAddr{blackHole.LocalAddr().(*net.UDPAddr), working},
+				"localhost",
+				tlsConf,
+				config,
+				early,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.CloseWithError(H3_NO_ERROR, "")
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("race took %s", elapsed)
+			}
+			if got := session.RemoteAddr().String(); got != working.String() {
+				t.Fatalf("connected to %s, want %s", got, working)
+			}
+		})
+	}
+}
+
+// TestDialerEarlyRemembered dials an address that never answers and a working
+// server after a session ticket was cached and the server remembered, the
+// early session must come from the server before its handshake completes
+// instead of waiting out the race.
+func TestDialerEarlyRemembered(t *testing.T) {
+	_, addr := startTestServer(t, ServerConfig{Enable0RTT: true}, nil)
+	working, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blackHole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackHole.Close()
+
+	cache := &notifyCache{ClientSessionCache: tls.NewLRUClientSessionCache(1), put: make(chan struct{}, 1)}
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: nextProtos, ServerName: "localhost", ClientSessionCache: cache}
+	config := &quic.Config{EnableDatagrams: true, HandshakeIdleTimeout: 5 * time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialer := &Dialer{AttemptDelay: time.Second}
+	session, err := dialer.dialAddr(ctx, working, "localhost", tlsConf.Clone(), config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cache.put:
+	case <-ctx.Done():
+		t.Fatal("no session ticket")
+	}
+	session.CloseWithError(H3_NO_ERROR, "")
+	rememberedAddrs.Store(addr, working)
+	defer rememberedAddrs.Delete(addr)
+
+	session, err = dialer.dialAddrs(ctx, []*net.UDPAddr{blackHole.LocalAddr().(*net.UDPAddr), working}, addr, tlsConf, config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.CloseWithError(H3_NO_ERROR, "")
+	select {
+	case <-session.(quic.EarlySession).HandshakeComplete().Done():
+		t.Fatal("early dial waited for the handshake")
+	default:
+	}
+	if got := session.RemoteAddr().String(); got != working.String() {
+		t.Fatalf("connected to %s, want %s", got, working)
+	}
+}
+
+func TestRememberedAddr(t *testing.T) {
+	remembered := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	rememberedAddrs.Store("example.com:443", remembered)
+	defer rememberedAddrs.Delete("example.com:443")
+
+	other := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	same := &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 443}
+	if got := rememberedAddr("example.com:443", []*net.UDPAddr{other, same}); got != same {
+		t.Fatalf("got %v, want %v", got, same)
+	}
+	if got := rememberedAddr("example.com:443", []*net.UDPAddr{other}); got != nil {
+		t.Fatalf("got %v for an address no longer resolved", got)
+	}
+	if got := rememberedAddr("example.org:443", []*net.UDPAddr{other, same}); got != nil {
+		t.Fatalf("got %v for an unknown host", got)
+	}
+}
+
+// TestDialerRaceLocalPort races from a fixed local port, the attempts must
+// share the socket instead of failing to bind it again.
+func TestDialerRaceLocalPort(t *testing.T) {
+	_, addr := startTestServer(t, ServerConfig{}, nil)
+	working, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blackHole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackHole.Close()
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	localAddr := free.LocalAddr().(*net.UDPAddr)
+	free.Close()
+
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: nextProtos}
+	config := &quic.Config{EnableDatagrams: true, HandshakeIdleTimeout: 5 * time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialer := &Dialer{LocalAddr: localAddr, AttemptDelay: 100 * time.Millisecond}
+	start := time.Now()
+	session, err := dialer.dialAddrs(ctx, []*net.UDPAddr{blackHole.LocalAddr().(*net.UDPAddr), working}, addr, tlsConf, config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.CloseWithError(H3_NO_ERROR, "")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("race took %s", elapsed)
+	}
+	if got := session.LocalAddr().String(); got != localAddr.String() {
+		t.Fatalf("dialed from %s, want %s", got, localAddr)
+	}
+}
+
+func TestSameFamily(t *testing.T) {
+	ipv6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	ipv4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	tests := []struct {
+		name  string
+		local net.IP
+		want  []*net.UDPAddr
+	}{
+		{"no ip", nil, []*net.UDPAddr{ipv6, ipv4}},
+		{"unspecified", net.IPv4zero, []*net.UDPAddr{ipv6, ipv4}},
+		{"ipv4", net.IPv4(127, 0, 0, 1), []*net.UDPAddr{ipv4}},
+		{"ipv6", net.IPv6loopback, []*net.UDPAddr{ipv6}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := sameFamily([]*net.UDPAddr{ipv6, ipv4}, test.local)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package webtransport
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EndpointPolicy decides the order Endpoints are tried in.
+type EndpointPolicy int
+
+const (
+	// EndpointOrdered tries the endpoints in the listed order.
+	EndpointOrdered EndpointPolicy = iota
+	// EndpointRandom tries the endpoints in a random order.
+	EndpointRandom
+	// EndpointLowestRTT tries the endpoint with the lowest handshake time
+	// first, endpoints without a measurement come first in listed order.
+	EndpointLowestRTT
+)
+
+// DefaultBlacklistDuration is how long a failed endpoint is skipped when
+// Endpoints.BlacklistDuration is not set.
+const DefaultBlacklistDuration = 30 * time.Second
+
+// Endpoints is a list of servers a client fails over between. Failed servers
+// are blacklisted for a while and handshake times are remembered, share one
+// Endpoints between the clients of a ReconnectingClient or a pool.
+type Endpoints struct {
+	// Addrs are host:port addresses of the servers.
+	Addrs  []string
+	Policy EndpointPolicy
+	// BlacklistDuration skips a failed endpoint for that long. When every
+	// endpoint is blacklisted they are tried anyway, the earliest to expire first.
+	BlacklistDuration time.Duration
+
+	mutex  sync.Mutex
+	states map[string]*endpointState
+}
+
+type endpointState struct {
+	blacklistedUntil time.Time
+	// smoothed handshake time, 0 until the first success
+	rtt time.Duration
+}
+
+// NewEndpoints returns Endpoints for addrs tried with policy.
+func NewEndpoints(addrs []string, policy EndpointPolicy) *Endpoints {
+	return &Endpoints{Addrs: addrs, Policy: policy}
+}
+
+// state must be called with the mutex held.
+func (e *Endpoints) state(addr string) *endpointState {
+	if e.states == nil {
+		e.states = make(map[string]*endpointState)
+	}
+	state, ok := e.states[addr]
+	if !ok {
+		state = &endpointState{}
+		e.states[addr] = state
+	}
+	return state
+}
+
+// candidates returns the addresses to try, in order.
+func (e *Endpoints) candidates() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	addrs := make([]string, len(e.Addrs))
+	copy(addrs, e.Addrs)
+	switch e.Policy {
+	case EndpointRandom:
+		rand.Shuffle(len(addrs), func(i, j int) {
+			addrs[i], addrs[j] = addrs[j], addrs[i]
+		})
+	case EndpointLowestRTT:
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return e.state(addrs[i]).rtt < e.state(addrs[j]).rtt
+		})
+	}
+
+	now := time.Now()
+	available := addrs[:0:0]
+	for _, addr := range addrs {
+		if !now.Before(e.state(addr).blacklistedUntil) {
+			available = append(available, addr)
+		}
+	}
+	if len(available) > 0 {
+		return available
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return e.state(addrs[i]).blacklistedUntil.Before(e.state(addrs[j]).blacklistedUntil)
+	})
+	return addrs
+}
+
+// succeeded clears the blacklist entry of addr and records its handshake time.
+func (e *Endpoints) succeeded(addr string, rtt time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	state := e.state(addr)
+	state.blacklistedUntil = time.Time{}
+	if state.rtt == 0 {
+		state.rtt = rtt
+	} else {
+		state.rtt = (7*state.rtt + rtt) / 8
+	}
+}
+
+// failed blacklists addr.
+func (e *Endpoints) failed(addr string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	duration := e.BlacklistDuration
+	if duration <= 0 {
+		duration = DefaultBlacklistDuration
+	}
+	e.state(addr).blacklistedUntil = time.Now().Add(duration)
+}
+
+// Blacklisted reports whether addr is currently skipped.
+func (e *Endpoints) Blacklisted(addr string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return time.Now().Before(e.state(addr).blacklistedUntil)
+}
@@ -0,0 +1,107 @@
+package webtransport
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestEndpointsCandidatesOrder(t *testing.T) {
+	addrs := []string{"a:443", "b:443", "c:443", "d:443"}
+	tests := []struct {
+		name   string
+		policy EndpointPolicy
+		rtts   map[string]time.Duration
+		want   []string
+	}{
+		{"ordered", EndpointOrdered, nil, addrs},
+		{"ordered ignores rtt", EndpointOrdered, map[string]time.Duration{"a:443": time.Second, "d:443": time.Millisecond}, addrs},
+		{"lowest rtt", EndpointLowestRTT,
+			map[string]time.Duration{"a:443": 40 * time.Millisecond, "b:443": 10 * time.Millisecond, "c:443": 30 * time.Millisecond, "d:443": 20 * time.Millisecond},
+			[]string{"b:443", "d:443", "c:443", "a:443"}},
+		{"unmeasured first in listed order", EndpointLowestRTT,
+			map[string]time.Duration{"a:443": 20 * time.Millisecond, "c:443": 10 * time.Millisecond},
+			[]string{"b:443", "d:443", "c:443", "a:443"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			endpoints := NewEndpoints(addrs, test.policy)
+			for addr, rtt := range test.rtts {
+				endpoints.succeeded(addr, rtt)
+			}
+			if got := endpoints.candidates(); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("candidates = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEndpointsRandomKeepsAll(t *testing.T) {
+	addrs := []string{"a:443", "b:443", "c:443"}
+	endpoints := NewEndpoints(addrs, EndpointRandom)
+	got := endpoints.candidates()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, addrs) {
+		t.Fatalf("candidates = %v, want a permutation of %v", got, addrs)
+	}
+}
+
+func TestEndpointsRTTSmoothing(t *testing.T) {
+	endpoints := NewEndpoints([]string{"a:443"}, EndpointLowestRTT)
+	endpoints.succeeded("a:443", 80*time.Millisecond)
+	endpoints.succeeded("a:443", 160*time.Millisecond)
+	if rtt := endpoints.state("a:443").rtt; rtt != 90*time.Millisecond {
+		t.Fatalf("rtt = %s, want 90ms", rtt)
+	}
+}
+
+func TestEndpointsBlacklist(t *testing.T) {
+	endpoints := NewEndpoints([]string{"a:443", "b:443", "c:443"}, EndpointOrdered)
+	endpoints.BlacklistDuration = time.Hour
+
+	endpoints.failed("a:443")
+	if !endpoints.Blacklisted("a:443") {
+		t.Fatal("failed endpoint not blacklisted")
+	}
+	if got, want := endpoints.candidates(), []string{"b:443", "c:443"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+
+	// every endpoint blacklisted: all are tried, the earliest to expire first
+	endpoints.failed("c:443")
+	endpoints.failed("b:443")
+	endpoints.mutex.Lock()
+	endpoints.state("a:443").blacklistedUntil = time.Now().Add(3 * time.Minute)
+	endpoints.state("b:443").blacklistedUntil = time.Now().Add(1 * time.Minute)
+	endpoints.state("c:443").blacklistedUntil = time.Now().Add(2 * time.Minute)
+	endpoints.mutex.Unlock()
+	if got, want := endpoints.candidates(), []string{"b:443", "c:443", "a:443"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+
+	// a success clears the entry
+	endpoints.succeeded("c:443", time.Millisecond)
+	if endpoints.Blacklisted("c:443") {
+		t.Fatal("succeeded endpoint still blacklisted")
+	}
+	if got, want := endpoints.candidates(), []string{"c:443"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+}
+
+func TestEndpointsBlacklistExpires(t *testing.T) {
+	endpoints := NewEndpoints([]string{"a:443", "b:443"}, EndpointOrdered)
+	endpoints.BlacklistDuration = 20 * time.Millisecond
+	endpoints.failed("a:443")
+	if got, want := endpoints.candidates(), []string{"b:443"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if endpoints.Blacklisted("a:443") {
+		t.Fatal("blacklist did not expire")
+	}
+	if got, want := endpoints.candidates(), []string{"a:443", "b:443"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+package webtransport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+var (
+	// ErrSessionClosed matches every error returned after a session ended,
+	// use errors.As with *SessionError for the cause.
+	ErrSessionClosed = errors.New("webtransport: session closed")
+
+	// ErrNotConnected is returned by client calls before Connect succeeded.
+	ErrNotConnected = errors.New("webtransport: client not connected")
+
+	// ErrAlreadyConnected is returned by Connect on an open client.
+	ErrAlreadyConnected = errors.New("webtransport: client already connected")
+
+	// ErrWebTransportUnsupported is returned by Connect when the server's
+	// SETTINGS do not enable WebTransport.
+	ErrWebTransportUnsupported = errors.New("webtransport: server does not support webtransport")
+
+	// ErrServerClosed is returned by Run, Serve and ServeListener after Close.
+	ErrServerClosed = errors.New("webtransport: server closed")
+)
+
+// SessionError is the cause a session ended with, it is returned by every
+// call blocked on or made after the closed session.
+type SessionError struct {
+	Code   quic.ApplicationErrorCode
+	Reason string
+	// Remote is set when the peer closed the session or the connection.
+	Remote bool
+	// Err is the QUIC or stream error the session ended with, nil for a
+	// local Close or a clean close of the CONNECT stream by the peer.
+	Err error
+}
+
+func (e *SessionError) Error() string {
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("webtransport: session closed: %v", e.Err)
+	case e.Remote:
+		return fmt.Sprintf("webtransport: session closed by peer with code %d: %s", e.Code, e.Reason)
+	default:
+		return fmt.Sprintf("webtransport: session closed with code %d: %s", e.Code, e.Reason)
+	}
+}
+
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SessionError) Is(target error) bool {
+	return target == ErrSessionClosed
+}
+
+// sessionError turns the error that ended a session into a *SessionError.
+func sessionError(err error) *SessionError {
+	if err == io.EOF {
+		return &SessionError{Remote: true}
+	}
+	var sessErr *SessionError
+	if errors.As(err, &sessErr) {
+		return sessErr
+	}
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) {
+		return &SessionError{Code: appErr.ErrorCode, Reason: appErr.ErrorMessage, Remote: appErr.Remote, Err: err}
+	}
+	var transportErr *quic.TransportError
+	if errors.As(err, &transportErr) {
+		return &SessionError{Remote: transportErr.Remote, Err: err}
+	}
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		// the peer reset the CONNECT stream
+		return &SessionError{Remote: true, Err: err}
+	}
+	return &SessionError{Err: err}
+}
+
+// ConnectError is returned by WebTransportClient.Connect when the session
+// could not be established.
+type ConnectError struct {
+	// StatusCode of the CONNECT response, 0 when no response was received.
+	StatusCode int
+	Err        error
+}
+
+func (e *ConnectError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("webtransport: CONNECT failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("webtransport: connect failed: %v", e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
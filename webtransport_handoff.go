@@ -0,0 +1,594 @@
+package webtransport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// RestartEnv lists the listen addresses whose sockets a process started by
+// Restart inherits, comma separated. The i-th socket is file descriptor
+// 3+2i, followed by the socket to the previous process.
+const RestartEnv = "WEBTRANSPORT_RESTART_ADDRS"
+
+// Messages on the unix socket between the previous and the next process.
+const (
+	// next → previous: a packet of a connection of the previous process
+	handoffPacket = 'p'
+	// previous → next: forward the packets from an address
+	handoffAddr = 'a'
+	// previous → next: end of the addresses known at the handoff
+	handoffEnd = 'e'
+	// previous → next: the last connection from an address is gone
+	handoffRemove = 'd'
+)
+
+// handoffConn is a UDP socket bound by Run that can be handed to the next
+// process. QUIC connection IDs are random in quic-go, so the packets of the
+// previous process are told apart by remote address: the previous process
+// sends the addresses of its connections, the next process forwards the
+// packets from them over a unix socket. After a NAT rebinding the packets of
+// an old connection are handled by the next process, which drops them as it
+// does not know their connection ID.
+//
+// handoffConn keeps the methods of *net.UDPConn, so quic-go reads ECN and
+// packet info with batched reads. Reads only take the slow path through
+// ReadFrom while packets are forwarded from or to another process.
+type handoffConn struct {
+	*net.UDPConn
+	batch      *ipv4.PacketConn
+	listenAddr string
+	// intercept is set while previous or next is set
+	intercept uint32
+
+	mutex sync.Mutex
+	// number of connections of this process per remote address
+	remotes map[string]int
+	// previous process, packets from the forwarded addresses belong to it
+	previous  *net.UnixConn
+	forwarded map[string]bool
+	// next process, set by Restart: the socket is read by it and the
+	// packets of our connections come from it
+	next *net.UnixConn
+	// messages for next, written by writeNext without holding mutex
+	queued [][]byte
+	wake   chan struct{}
+}
+
+func newHandoffConn(udp *net.UDPConn, listenAddr string) *handoffConn {
+	return &handoffConn{
+		UDPConn:    udp,
+		batch:      ipv4.NewPacketConn(udp),
+		listenAddr: listenAddr,
+		remotes:    make(map[string]int),
+	}
+}
+
+// setIntercept updates intercept, c.mutex is held.
+func (c *handoffConn) setIntercept() {
+	var intercept uint32
+	if c.previous != nil || c.next != nil {
+		intercept = 1
+	}
+	atomic.StoreUint32(&c.intercept, intercept)
+}
+
+func (c *handoffConn) intercepting() bool {
+	return atomic.LoadUint32(&c.intercept) != 0
+}
+
+// ReadBatch is used by quic-go instead of ReadFrom where it reads batches.
+func (c *handoffConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	for !c.intercepting() {
+		n, err := c.batch.ReadBatch(ms, flags)
+		if err != nil && c.intercepting() {
+			// Restart interrupted the read
+			break
+		}
+		return n, err
+	}
+	n, addr, err := c.ReadFrom(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].NN, ms[0].Flags, ms[0].Addr = n, 0, 0, addr
+	return 1, nil
+}
+
+func (c *handoffConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		if !c.intercepting() {
+			n, addr, err := c.UDPConn.ReadFrom(p)
+			if err != nil && c.intercepting() {
+				// Restart interrupted the read
+				continue
+			}
+			return n, addr, err
+		}
+
+		c.mutex.Lock()
+		next := c.next
+		c.mutex.Unlock()
+		if next != nil {
+			n, addr, err := c.readForwarded(next, p)
+			if err != nil {
+				c.mutex.Lock()
+				tookBack := c.next != next
+				c.mutex.Unlock()
+				if tookBack {
+					// the next process failed to start
+					continue
+				}
+			}
+			return n, addr, err
+		}
+
+		n, addr, err := c.UDPConn.ReadFrom(p)
+		if err != nil {
+			if c.handedOff() {
+				// Restart interrupted the read
+				continue
+			}
+			return n, addr, err
+		}
+		if c.forward(addr, p[:n]) {
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+func (c *handoffConn) handedOff() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.next != nil
+}
+
+// readForwarded reads a packet the next process forwarded to us.
+func (c *handoffConn) readForwarded(next *net.UnixConn, p []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(p)+2+255)
+	for {
+		n, err := next.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		msgType, addr, payload, err := parseHandoffMessage(buf[:n])
+		if err != nil || msgType != handoffPacket {
+			continue
+		}
+		remoteAddr, err := parseUDPAddr(addr)
+		if err != nil {
+			continue
+		}
+		return copy(p, payload), remoteAddr, nil
+	}
+}
+
+// forward hands a packet from an address of the previous process to it.
+func (c *handoffConn) forward(addr net.Addr, packet []byte) bool {
+	c.mutex.Lock()
+	previous := c.previous
+	forwarded := previous != nil && c.forwarded[addr.String()]
+	c.mutex.Unlock()
+	if !forwarded {
+		return false
+	}
+	if _, err := previous.Write(handoffMessage(handoffPacket, addr.String(), packet)); err != nil {
+		log.Printf("[webtransport]previous process is gone, stop forwarding: %v", err)
+		c.stopForwarding(previous)
+		return false
+	}
+	return true
+}
+
+// stopForwarding forgets previous once it is gone.
+func (c *handoffConn) stopForwarding(previous *net.UnixConn) {
+	c.mutex.Lock()
+	if c.previous == previous {
+		c.previous = nil
+		c.forwarded = nil
+		c.setIntercept()
+	}
+	c.mutex.Unlock()
+	previous.Close()
+}
+
+// watchPrevious applies the address updates of the previous process until it exits.
+func (c *handoffConn) watchPrevious(previous *net.UnixConn) {
+	buf := make([]byte, 2+255)
+	for {
+		n, err := previous.Read(buf)
+		if err != nil {
+			break
+		}
+		msgType, addr, _, err := parseHandoffMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		c.mutex.Lock()
+		if c.previous == previous {
+			switch msgType {
+			case handoffAddr:
+				c.forwarded[addr] = true
+			case handoffRemove:
+				delete(c.forwarded, addr)
+			}
+		}
+		c.mutex.Unlock()
+	}
+	c.stopForwarding(previous)
+}
+
+// track counts a connection from remote, the next process forwards its
+// packets once the socket is handed off.
+func (c *handoffConn) track(remote string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remotes[remote]++
+	if c.remotes[remote] == 1 && c.next != nil {
+		c.send(handoffMessage(handoffAddr, remote, nil))
+	}
+}
+
+func (c *handoffConn) untrack(remote string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remotes[remote]--
+	if c.remotes[remote] > 0 {
+		return
+	}
+	delete(c.remotes, remote)
+	if c.next != nil {
+		c.send(handoffMessage(handoffRemove, remote, nil))
+	}
+}
+
+// send queues a message for the next process, c.mutex is held.
+func (c *handoffConn) send(msg []byte) {
+	c.queued = append(c.queued, msg)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// handOff stops reading the socket and queues the addresses of our
+// connections for the next process, it returns the file of the next
+// process's end. Nothing is written before startWriting.
+func (c *handoffConn) handOff() (*os.File, error) {
+	next, file, err := socketpair()
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.next = next
+	c.wake = make(chan struct{}, 1)
+	c.queued = nil
+	for remote := range c.remotes {
+		c.send(handoffMessage(handoffAddr, remote, nil))
+	}
+	c.send(handoffMessage(handoffEnd, "", nil))
+	c.setIntercept()
+	c.mutex.Unlock()
+
+	// the next process reads the socket from now on
+	c.UDPConn.SetReadDeadline(time.Now())
+	return file, nil
+}
+
+// startWriting writes the queued messages once the next process started.
+func (c *handoffConn) startWriting() {
+	c.mutex.Lock()
+	next, wake := c.next, c.wake
+	c.mutex.Unlock()
+	if next != nil {
+		go c.writeNext(next, wake)
+	}
+}
+
+// writeNext writes the queued messages to next until it is taken back or
+// gone. The next process reads them once it runs, so the writes may block.
+func (c *handoffConn) writeNext(next *net.UnixConn, wake chan struct{}) {
+	for range wake {
+		c.mutex.Lock()
+		msgs := c.queued
+		c.queued = nil
+		c.mutex.Unlock()
+		for _, msg := range msgs {
+			if _, err := next.Write(msg); err != nil {
+				log.Printf("[webtransport]next process is gone, stop sending addresses: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// stopNext forgets the next process, c.mutex is held.
+func (c *handoffConn) stopNext() *net.UnixConn {
+	next := c.next
+	if next != nil {
+		close(c.wake)
+		c.next, c.wake, c.queued = nil, nil, nil
+		c.setIntercept()
+	}
+	return next
+}
+
+// takeBack reads the socket again after the next process failed to start,
+// a read of the forwarded packets returns to the socket.
+func (c *handoffConn) takeBack() {
+	c.UDPConn.SetReadDeadline(time.Time{})
+	c.mutex.Lock()
+	next := c.stopNext()
+	c.mutex.Unlock()
+	if next != nil {
+		next.Close()
+	}
+}
+
+func (c *handoffConn) Close() error {
+	c.mutex.Lock()
+	if c.previous != nil {
+		c.previous.Close()
+		c.previous = nil
+	}
+	if next := c.stopNext(); next != nil {
+		next.Close()
+	}
+	c.mutex.Unlock()
+	return c.UDPConn.Close()
+}
+
+// handoffMessage encodes a message type, an address and a payload.
+func handoffMessage(msgType byte, addr string, payload []byte) []byte {
+	msg := make([]byte, 0, 2+len(addr)+len(payload))
+	msg = append(msg, msgType, byte(len(addr)))
+	msg = append(msg, addr...)
+	return append(msg, payload...)
+}
+
+func parseHandoffMessage(msg []byte) (byte, string, []byte, error) {
+	if len(msg) < 2 || len(msg) < 2+int(msg[1]) {
+		return 0, "", nil, errors.New("short handoff message")
+	}
+	return msg[0], string(msg[2 : 2+int(msg[1])]), msg[2+int(msg[1]):], nil
+}
+
+func parseUDPAddr(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	zone := ""
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %s", addr)
+	}
+	return &net.UDPAddr{IP: ip, Port: portNumber, Zone: zone}, nil
+}
+
+var (
+	inheritOnce  sync.Once
+	inheritMutex sync.Mutex
+	inherited    map[string][]*handoffConn
+)
+
+// inheritedSocket returns a socket a previous process handed over for
+// listenAddr, nil when there is none. Each socket is returned once, the
+// sockets of ListenWorkers are listed once each.
+func inheritedSocket(listenAddr string) *handoffConn {
+	inheritOnce.Do(func() {
+		value := os.Getenv(RestartEnv)
+		if value == "" {
+			return
+		}
+		os.Unsetenv(RestartEnv)
+		inherited = make(map[string][]*handoffConn)
+		for i, addr := range strings.Split(value, ",") {
+			socket, err := inheritSocket(addr, 3+2*i)
+			if err != nil {
+				log.Printf("[webtransport]inherit socket of %s failed: %v", addr, err)
+				continue
+			}
+			inherited[addr] = append(inherited[addr], socket)
+		}
+	})
+	inheritMutex.Lock()
+	defer inheritMutex.Unlock()
+	sockets := inherited[listenAddr]
+	if len(sockets) == 0 {
+		return nil
+	}
+	inherited[listenAddr] = sockets[1:]
+	return sockets[0]
+}
+
+// inheritSocket takes over the socket at fd and the unix socket to the
+// previous process at fd+1.
+func inheritSocket(listenAddr string, fd int) (*handoffConn, error) {
+	udpFile := os.NewFile(uintptr(fd), "udp:"+listenAddr)
+	previousFile := os.NewFile(uintptr(fd+1), "handoff:"+listenAddr)
+	defer udpFile.Close()
+	defer previousFile.Close()
+
+	conn, err := net.FilePacketConn(udpFile)
+	if err != nil {
+		return nil, err
+	}
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("fd %d is not a UDP socket", fd)
+	}
+	conn, err = net.FilePacketConn(previousFile)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	previous, ok := conn.(*net.UnixConn)
+	if !ok {
+		udp.Close()
+		conn.Close()
+		return nil, fmt.Errorf("fd %d is not a unix socket", fd+1)
+	}
+
+	socket := newHandoffConn(udp, listenAddr)
+	// the addresses known at the handoff are forwarded from the first packet
+	forwarded, err := readForwardedAddrs(previous)
+	if err != nil {
+		previous.Close()
+		return socket, nil
+	}
+	socket.previous = previous
+	socket.forwarded = forwarded
+	socket.setIntercept()
+	go socket.watchPrevious(previous)
+	return socket, nil
+}
+
+// readForwardedAddrs reads the addresses the previous process sends up to
+// the end of the list.
+func readForwardedAddrs(previous *net.UnixConn) (map[string]bool, error) {
+	forwarded := make(map[string]bool)
+	buf := make([]byte, 2+255)
+	for {
+		n, err := previous.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		msgType, addr, _, err := parseHandoffMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch msgType {
+		case handoffEnd:
+			return forwarded, nil
+		case handoffAddr:
+			forwarded[addr] = true
+		}
+	}
+}
+
+// startRestart starts the process of Restart, tests replace it.
+var startRestart = (*exec.Cmd).Start
+
+// Restart starts a new process with the same arguments and hands it the
+// sockets bound by Run, so the listen addresses are never unbound. The new
+// process passes ListenAddr and ListenAddrs unchanged to Run to take them over.
+// The packets of the connections of this process are forwarded to it by the
+// new process. Call Shutdown afterwards to drain them.
+func (s *WebTransportServer) Restart() (*os.Process, error) {
+	s.mutex.Lock()
+	sockets := make([]*handoffConn, 0, len(s.sockets))
+	for _, socket := range s.sockets {
+		sockets = append(sockets, socket)
+	}
+	s.mutex.Unlock()
+	if len(sockets) == 0 {
+		return nil, errors.New("no socket to hand off, Restart needs Run")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	var addrs []string
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	takeBack := func() {
+		for _, socket := range sockets {
+			socket.takeBack()
+		}
+	}
+	for _, socket := range sockets {
+		udpFile, err := socket.UDPConn.File()
+		if err != nil {
+			takeBack()
+			return nil, err
+		}
+		files = append(files, udpFile)
+		nextFile, err := socket.handOff()
+		if err != nil {
+			takeBack()
+			return nil, err
+		}
+		files = append(files, nextFile)
+		addrs = append(addrs, socket.listenAddr)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), RestartEnv+"="+strings.Join(addrs, ","))
+	cmd.ExtraFiles = files
+	err = startRestart(cmd)
+	for _, socket := range sockets {
+		if err := setNonblock(socket.UDPConn); err != nil {
+			log.Printf("[webtransport]restore non-blocking mode of %s failed: %v", socket.listenAddr, err)
+		}
+	}
+	if err != nil {
+		takeBack()
+		return nil, err
+	}
+	for _, socket := range sockets {
+		socket.startWriting()
+	}
+	log.Printf("[webtransport]handed %s to process %d", strings.Join(addrs, ","), cmd.Process.Pid)
+	return cmd.Process, nil
+}
+
+// Shutdown stops taking new connections and waits for the established ones
+// to end, then closes the server. When ctx is done first the remaining
+// connections are closed and ctx.Err() is returned.
+func (s *WebTransportServer) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.draining = true
+	s.mutex.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+	for s.activeConnections() > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *WebTransportServer) activeConnections() int64 {
+	var n int64
+	for _, stats := range s.ListenerStats() {
+		n += stats.ActiveConnections
+	}
+	return n
+}
@@ -0,0 +1,137 @@
+//go:build !windows
+// +build !windows
+
+package webtransport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestRestartStartFailure hands the sockets off to a process that fails to
+// start, the server must take them back and keep its sessions and listener.
+func TestRestartStartFailure(t *testing.T) {
+	server := CreateWebTransportServer(ServerConfig{ListenAddr: "127.0.0.1:0"})
+	go func() {
+		for transport := range server.Webtransport {
+			go func(transport *WebTransport) {
+				<-transport.Context().Done()
+			}(transport)
+		}
+	}()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Run()
+	}()
+	defer func() {
+		server.Close()
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("Run = %v", err)
+		}
+	}()
+	waitFor(t, 5*time.Second, func() bool {
+		return len(server.ListenerStats()) == 1
+	})
+	addr := server.ListenerStats()[0].Addr.String()
+
+	connect := func() *WebTransportClient {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client := CreateWebTransportClient(testClientConfig(addr))
+		if err := client.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	before := connect()
+	defer before.Close(H3_NO_ERROR, "")
+
+	startRestart = func(cmd *exec.Cmd) error {
+		// the next process reads the socket until Start fails
+		time.Sleep(100 * time.Millisecond)
+		cmd.Path = "/nonexistent/webtransport-restart"
+		return cmd.Start()
+	}
+	defer func() {
+		startRestart = (*exec.Cmd).Start
+	}()
+	if _, err := server.Restart(); err == nil {
+		t.Fatal("Restart started a nonexistent executable")
+	}
+
+	after := connect()
+	defer after.Close(H3_NO_ERROR, "")
+	if state := before.State(); state != StateOpen {
+		t.Fatalf("session before Restart is %s", state)
+	}
+	if _, err := before.CreateStream(); err != nil {
+		t.Fatalf("session before Restart: %v", err)
+	}
+}
+
+// TestHandOffManyRemotes hands off more remotes than the socket pair buffers.
+// handOff and track must not block while the next process is not reading,
+// the next process then gets every address.
+func TestHandOffManyRemotes(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := newHandoffConn(udp, udp.LocalAddr().String())
+	defer socket.Close()
+	const remotes, later = 1500, 100
+	for i := 0; i < remotes; i++ {
+		socket.track(fmt.Sprintf("192.0.2.%d:%d", i%250+1, 1024+i))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		file, err := socket.handOff()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer file.Close()
+		for i := 0; i < later; i++ {
+			socket.track(fmt.Sprintf("198.51.100.1:%d", 1024+i))
+		}
+		socket.startWriting()
+
+		conn, err := net.FilePacketConn(file)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		next := conn.(*net.UnixConn)
+		defer next.Close()
+		forwarded, err := readForwardedAddrs(next)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(forwarded) != remotes {
+			t.Errorf("%d addresses at the handoff, want %d", len(forwarded), remotes)
+		}
+		buf := make([]byte, 2+255)
+		for i := 0; i < later; i++ {
+			n, err := next.Read(buf)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if msgType, _, _, _ := parseHandoffMessage(buf[:n]); msgType != handoffAddr {
+				t.Errorf("message %q after the handoff", msgType)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handoff blocked")
+	}
+}
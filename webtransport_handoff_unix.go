@@ -0,0 +1,80 @@
+//go:build !windows
+// +build !windows
+
+package webtransport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDP binds addr, with SO_REUSEPORT when reusePort is set.
+func listenUDP(addr string, reusePort bool) (*net.UDPConn, error) {
+	config := net.ListenConfig{}
+	if reusePort {
+		config.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			if controlErr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); controlErr != nil {
+				return controlErr
+			}
+			return os.NewSyscallError("setsockopt SO_REUSEPORT", err)
+		}
+	}
+	conn, err := config.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// socketpair returns our end of a unix datagram socket pair and the file of
+// the other end, for the next process.
+func socketpair() (*net.UnixConn, *os.File, error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+
+	file := os.NewFile(uintptr(fds[0]), "handoff")
+	defer file.Close()
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		syscall.Close(fds[1])
+		return nil, nil, fmt.Errorf("socketpair returned %T", conn)
+	}
+	return unixConn, os.NewFile(uintptr(fds[1]), "handoff"), nil
+}
+
+// setNonblock puts udp back in non-blocking mode, os/exec puts the files it
+// passes to a process in blocking mode and a duplicate shares the mode.
+func setNonblock(udp *net.UDPConn) error {
+	rawConn, err := udp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if controlErr := rawConn.Control(func(fd uintptr) {
+		err = syscall.SetNonblock(int(fd), true)
+	}); controlErr != nil {
+		return controlErr
+	}
+	return os.NewSyscallError("setnonblock", err)
+}
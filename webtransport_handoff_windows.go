@@ -0,0 +1,26 @@
+package webtransport
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func listenUDP(addr string, reusePort bool) (*net.UDPConn, error) {
+	if reusePort {
+		return nil, errors.New("SO_REUSEPORT is not supported on windows")
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", udpAddr)
+}
+
+func socketpair() (*net.UnixConn, *os.File, error) {
+	return nil, nil, errors.New("socket handoff is not supported on windows")
+}
+
+func setNonblock(udp *net.UDPConn) error {
+	return nil
+}
@@ -0,0 +1,71 @@
+package webtransport
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// ListenerStats counts the connections and sessions accepted on one listener.
+type ListenerStats struct {
+	Addr net.Addr
+	// Connections and Sessions are totals since the listener started.
+	Connections       uint64
+	ActiveConnections int64
+	Sessions          uint64
+	ActiveSessions    int64
+}
+
+type listenerStats struct {
+	addr              net.Addr
+	connections       uint64
+	activeConnections int64
+	sessions          uint64
+	activeSessions    int64
+}
+
+func (s *listenerStats) snapshot() ListenerStats {
+	return ListenerStats{
+		Addr:              s.addr,
+		Connections:       atomic.LoadUint64(&s.connections),
+		ActiveConnections: atomic.LoadInt64(&s.activeConnections),
+		Sessions:          atomic.LoadUint64(&s.sessions),
+		ActiveSessions:    atomic.LoadInt64(&s.activeSessions),
+	}
+}
+
+// ListenerStats returns the stats of the listeners the server accepts on.
+func (s *WebTransportServer) ListenerStats() []ListenerStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := make([]ListenerStats, 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		stats = append(stats, listener.snapshot())
+	}
+	return stats
+}
+
+// Sessions returns the established sessions of every listener.
+func (s *WebTransportServer) Sessions() []*WebTransport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	transports := make([]*WebTransport, 0, len(s.transports))
+	for transport := range s.transports {
+		transports = append(transports, transport)
+	}
+	return transports
+}
+
+func (s *WebTransportServer) track(transport *WebTransport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.transports == nil {
+		s.transports = make(map[*WebTransport]struct{})
+	}
+	s.transports[transport] = struct{}{}
+}
+
+func (s *WebTransportServer) untrack(transport *WebTransport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.transports, transport)
+}
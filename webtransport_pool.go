@@ -0,0 +1,113 @@
+package webtransport
+
+import (
+	"context"
+	"sync"
+)
+
+// PoolConfig configures a ClientPool. ClientConfig is the template every
+// session is created from.
+type PoolConfig struct {
+	ClientConfig
+
+	// MaxSessionsPerConnection caps the sessions opened over one QUIC
+	// connection, the limit the server advertises applies too. Defaults to
+	// DefaultMaxSessionsPerConnection.
+	MaxSessionsPerConnection int
+}
+
+// ClientPool opens WebTransport sessions over shared QUIC connections, like
+// the browser's allowPooling option. A new connection is dialed when every
+// connection is full. Servers that do not advertise multiple sessions get
+// one connection per session.
+type ClientPool struct {
+	PoolConfig
+
+	mutex  sync.Mutex
+	conns  []*clientConn
+	closed bool
+}
+
+func CreateClientPool(config PoolConfig) *ClientPool {
+	if config.MaxSessionsPerConnection <= 0 {
+		config.MaxSessionsPerConnection = DefaultMaxSessionsPerConnection
+	}
+	return &ClientPool{PoolConfig: config}
+}
+
+// Dial opens a session over a pooled connection.
+func (p *ClientPool) Dial(ctx context.Context) (*WebTransportClient, error) {
+	client := CreateWebTransportClient(p.ClientConfig)
+	if err := client.connect(ctx, p); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// reserve takes a session slot on a pooled connection, it returns nil when
+// every connection is full. A nil pool has no connections.
+func (p *ClientPool) reserve() *clientConn {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	conns := p.conns[:0]
+	var reserved *clientConn
+	for _, conn := range p.conns {
+		if conn.isClosed() {
+			continue
+		}
+		conns = append(conns, conn)
+		if reserved == nil && conn.reserve() {
+			reserved = conn
+		}
+	}
+	for i := len(conns); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+	p.conns = conns
+	return reserved
+}
+
+// add makes a new connection available to later sessions.
+func (p *ClientPool) add(conn *clientConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		// the session being opened is the last one over it
+		conn.mutex.Lock()
+		conn.closeWhenIdle = true
+		conn.mutex.Unlock()
+		return
+	}
+	p.conns = append(p.conns, conn)
+}
+
+// Connections returns the number of open QUIC connections in the pool.
+func (p *ClientPool) Connections() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	n := 0
+	for _, conn := range p.conns {
+		if !conn.isClosed() {
+			n++
+		}
+	}
+	return n
+}
+
+// Close closes every pooled connection and the sessions over them.
+func (p *ClientPool) Close() error {
+	p.mutex.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = nil
+	p.mutex.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.session.CloseWithError(H3_NO_ERROR, "")
+	}
+	return nil
+}
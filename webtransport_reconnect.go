@@ -0,0 +1,276 @@
+package webtransport
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// Defaults of ReconnectConfig.
+const (
+	DefaultInitialBackoff     = 500 * time.Millisecond
+	DefaultMaxBackoff         = 30 * time.Second
+	DefaultBackoffMultiplier  = 2
+	DefaultBackoffJitter      = 0.2
+	DefaultMaxQueuedDatagrams = 64
+)
+
+// ErrDatagramQueueFull is returned by ReconnectingClient.SendMessage when the
+// session is down and MaxQueuedDatagrams datagrams are already waiting.
+var ErrDatagramQueueFull = errors.New("webtransport: datagram queue is full")
+
+// ReconnectConfig configures a ReconnectingClient. ClientConfig is the
+// template every session is created from.
+type ReconnectConfig struct {
+	ClientConfig
+
+	// InitialBackoff is the delay before the first reconnect attempt, it
+	// grows by BackoffMultiplier up to MaxBackoff. Unset fields take the
+	// Default values above.
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	// BackoffJitter randomizes each delay by up to this fraction, in (0, 1].
+	BackoffJitter float64
+
+	// MaxRetries gives up after that many failed attempts in a row, 0 retries
+	// forever.
+	MaxRetries int
+
+	// MaxQueuedDatagrams bounds the datagrams sent while disconnected, they
+	// are sent in order once reconnected.
+	MaxQueuedDatagrams int
+
+	// OnConnected is called after every successful connect, including the
+	// first, to re-establish application streams. A returned error closes
+	// the session and counts as a failed attempt.
+	OnConnected func(client *WebTransportClient) error
+
+	// OnDisconnect is called when an established session is lost.
+	OnDisconnect func(err error)
+
+	// OnReconnecting is called before each attempt with its number and delay.
+	OnReconnecting func(attempt int, delay time.Duration)
+
+	// OnReconnected is called once a new session is established.
+	OnReconnected func(client *WebTransportClient)
+
+	// OnReconnectFailed is called when MaxRetries is reached, the client is
+	// closed afterwards.
+	OnReconnectFailed func(err error)
+}
+
+// ReconnectingClient keeps a WebTransport session to the server, replacing it
+// with a new one when it is lost.
+type ReconnectingClient struct {
+	ReconnectConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex  sync.Mutex
+	client *WebTransportClient
+	queue  [][]byte
+}
+
+func CreateReconnectingClient(config ReconnectConfig) *ReconnectingClient {
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = DefaultInitialBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultMaxBackoff
+	}
+	if config.BackoffMultiplier < 1 {
+		config.BackoffMultiplier = DefaultBackoffMultiplier
+	}
+	if config.BackoffJitter <= 0 || config.BackoffJitter > 1 {
+		config.BackoffJitter = DefaultBackoffJitter
+	}
+	if config.MaxQueuedDatagrams <= 0 {
+		config.MaxQueuedDatagrams = DefaultMaxQueuedDatagrams
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ReconnectingClient{
+		ReconnectConfig: config,
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+}
+
+// Connect establishes the first session and keeps reconnecting afterwards.
+// It does not retry, the error of the first attempt is returned.
+func (r *ReconnectingClient) Connect(ctx context.Context) error {
+	client, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if !r.setClient(client) {
+		return ErrSessionClosed
+	}
+	go r.run(client)
+	return nil
+}
+
+// Client returns the current session, nil while reconnecting.
+func (r *ReconnectingClient) Client() *WebTransportClient {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.client
+}
+
+// SendMessage sends a datagram on the current session, or queues it while
+// reconnecting.
+func (r *ReconnectingClient) SendMessage(message []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.ctx.Err(); err != nil {
+		return ErrSessionClosed
+	}
+	if r.client != nil {
+		err := r.client.SendMessage(message)
+		if err == nil || !errors.Is(err, ErrSessionClosed) {
+			return err
+		}
+	}
+	if len(r.queue) >= r.MaxQueuedDatagrams {
+		return ErrDatagramQueueFull
+	}
+	r.queue = append(r.queue, message)
+	return nil
+}
+
+// Close stops reconnecting and closes the current session.
+func (r *ReconnectingClient) Close(code quic.ApplicationErrorCode, message string) error {
+	r.cancel()
+
+	r.mutex.Lock()
+	client := r.client
+	r.client = nil
+	r.queue = nil
+	r.mutex.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	return client.Close(code, message)
+}
+
+func (r *ReconnectingClient) connect(ctx context.Context) (*WebTransportClient, error) {
+	client := CreateWebTransportClient(r.ClientConfig)
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
+	}
+	if r.OnConnected != nil {
+		if err := r.OnConnected(client); err != nil {
+			client.Close(H3_NO_ERROR, "")
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// setClient makes client current and sends the queued datagrams on it. It
+// closes client and fails when Close was called in the meantime.
+func (r *ReconnectingClient) setClient(client *WebTransportClient) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.ctx.Err() != nil {
+		client.Close(H3_NO_ERROR, "")
+		return false
+	}
+	r.client = client
+	for len(r.queue) > 0 {
+		if err := client.SendMessage(r.queue[0]); err != nil {
+			log.Printf("[webtransport_client]send queued datagram failed: %v", err)
+			return true
+		}
+		r.queue[0] = nil
+		r.queue = r.queue[1:]
+	}
+	return true
+}
+
+// run waits for the session to end and replaces it until Close is called.
+func (r *ReconnectingClient) run(client *WebTransportClient) {
+	for {
+		select {
+		case <-client.Context().Done():
+		case <-r.ctx.Done():
+			return
+		}
+
+		r.mutex.Lock()
+		if r.client == client {
+			r.client = nil
+		}
+		r.mutex.Unlock()
+		if r.ctx.Err() != nil {
+			return
+		}
+		if r.OnDisconnect != nil {
+			r.OnDisconnect(Cause(client.Context()))
+		}
+
+		var ok bool
+		client, ok = r.reconnect()
+		if !ok || !r.setClient(client) {
+			return
+		}
+		if r.OnReconnected != nil {
+			r.OnReconnected(client)
+		}
+	}
+}
+
+// reconnect retries with backoff until a session is established, Close is
+// called or MaxRetries is reached.
+func (r *ReconnectingClient) reconnect() (*WebTransportClient, bool) {
+	var lastErr error
+	for attempt := 1; r.MaxRetries == 0 || attempt <= r.MaxRetries; attempt++ {
+		delay := r.backoff(attempt)
+		if r.OnReconnecting != nil {
+			r.OnReconnecting(attempt, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			timer.Stop()
+			return nil, false
+		}
+
+		client, err := r.connect(r.ctx)
+		if err == nil {
+			return client, true
+		}
+		log.Printf("[webtransport_client]reconnect attempt %d failed: %v", attempt, err)
+		lastErr = err
+		if r.ctx.Err() != nil {
+			return nil, false
+		}
+	}
+
+	if r.OnReconnectFailed != nil {
+		r.OnReconnectFailed(lastErr)
+	}
+	r.Close(H3_NO_ERROR, "")
+	return nil, false
+}
+
+// backoff returns the jittered delay before an attempt.
+func (r *ReconnectingClient) backoff(attempt int) time.Duration {
+	delay := float64(r.InitialBackoff) * math.Pow(r.BackoffMultiplier, float64(attempt-1))
+	if delay > float64(r.MaxBackoff) {
+		delay = float64(r.MaxBackoff)
+	}
+	delay *= 1 + r.BackoffJitter*(2*rand.Float64()-1)
+	return time.Duration(delay)
+}
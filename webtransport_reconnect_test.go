@@ -0,0 +1,106 @@
+package webtransport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ReconnectConfig
+		want   []time.Duration
+	}{
+		{"grows", ReconnectConfig{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Hour, BackoffMultiplier: 2},
+			[]time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond}},
+		{"multiplier 1 stays", ReconnectConfig{InitialBackoff: time.Second, MaxBackoff: time.Hour, BackoffMultiplier: 1},
+			[]time.Duration{time.Second, time.Second, time.Second}},
+		{"capped", ReconnectConfig{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, BackoffMultiplier: 3},
+			[]time.Duration{time.Second, 3 * time.Second, 5 * time.Second, 5 * time.Second}},
+		{"initial above max", ReconnectConfig{InitialBackoff: time.Minute, MaxBackoff: time.Second, BackoffMultiplier: 2},
+			[]time.Duration{time.Second, time.Second}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &ReconnectingClient{ReconnectConfig: test.config}
+			for i, want := range test.want {
+				if got := r.backoff(i + 1); got != want {
+					t.Fatalf("attempt %d: got %s, want %s", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReconnectBackoffJitter(t *testing.T) {
+	r := CreateReconnectingClient(ReconnectConfig{MaxBackoff: 4 * DefaultInitialBackoff})
+	for attempt := 1; attempt <= 5; attempt++ {
+		base := DefaultInitialBackoff << (attempt - 1)
+		if base > r.MaxBackoff {
+			base = r.MaxBackoff
+		}
+		low := time.Duration(float64(base) * (1 - DefaultBackoffJitter))
+		high := time.Duration(float64(base) * (1 + DefaultBackoffJitter))
+		for i := 0; i < 100; i++ {
+			if got := r.backoff(attempt); got < low || got > high {
+				t.Fatalf("attempt %d: %s not in [%s, %s]", attempt, got, low, high)
+			}
+		}
+	}
+}
+
+func TestReconnectMaxRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		// closeAt closes the client before that attempt, 0 never
+		closeAt      int
+		wantAttempts int
+		wantFailed   int
+	}{
+		{"one", 1, 0, 1, 1},
+		{"three", 3, 0, 3, 1},
+		{"forever until closed", 0, 5, 5, 0},
+		{"closed before the limit", 3, 2, 2, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var r *ReconnectingClient
+			attempts, failed := 0, 0
+			r = CreateReconnectingClient(ReconnectConfig{
+				ClientConfig: ClientConfig{
+					RemoteAddr:           "127.0.0.1:1",
+					HandshakeIdleTimeout: 50 * time.Millisecond,
+				},
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     time.Millisecond,
+				MaxRetries:     test.maxRetries,
+				OnReconnecting: func(attempt int, delay time.Duration) {
+					attempts = attempt
+					if attempt == test.closeAt {
+						r.Close(H3_NO_ERROR, "")
+					}
+				},
+				OnReconnectFailed: func(err error) {
+					if err == nil {
+						t.Error("OnReconnectFailed without an error")
+					}
+					failed++
+				},
+			})
+			if client, ok := r.reconnect(); ok {
+				client.Close(H3_NO_ERROR, "")
+				t.Fatal("reconnected to a closed port")
+			}
+			if attempts != test.wantAttempts {
+				t.Fatalf("%d attempts, want %d", attempts, test.wantAttempts)
+			}
+			if failed != test.wantFailed {
+				t.Fatalf("OnReconnectFailed called %d times, want %d", failed, test.wantFailed)
+			}
+			if r.ctx.Err() == nil {
+				t.Fatal("client not closed after giving up")
+			}
+		})
+	}
+}
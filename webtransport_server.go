@@ -1,20 +1,23 @@
 package webtransport
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
-	"io"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"git.baijiashilian.com/shared/brtc/webtransport-go/h3"
-
 	"github.com/lucas-clemente/quic-go"
-	"github.com/lucas-clemente/quic-go/http3"
-	"github.com/lucas-clemente/quic-go/quicvarint"
-	"github.com/marten-seemann/qpack"
 )
 
 // ClientIndication, see https://tools.ietf.org/html/draft-vvv-webtransport-quic-02#section-3.2
@@ -30,10 +33,67 @@ type ServerConfig struct {
 	http.Handler
 	// ListenAddr sets an address to bind server to.
 	ListenAddr string
+	// ListenAddrs are bound together with ListenAddr, all of them share the
+	// handler and the sessions. An unspecified IPv6 address such as
+	// "[::]:4433" takes IPv4 too, list "0.0.0.0:4433" and a specific IPv6
+	// address to serve both families on separate sockets.
+	ListenAddrs []string
+	// IgnoreBindErrors logs and skips listen addresses that fail to bind,
+	// Run fails only when none binds. Otherwise a failed address fails Run.
+	IgnoreBindErrors bool
+	// ListenWorkers binds each listen address that many times with
+	// SO_REUSEPORT, each socket with its own quic-go listener and accept
+	// loop, so one process scales across cores. The kernel hashes the
+	// address tuple of a packet to pick the socket, see README for how
+	// connections stay on their socket. Changing it needs a full restart,
+	// Restart hands over the sockets as they are. Defaults to 1, without
+	// SO_REUSEPORT. Listen addresses need a fixed port with more than one
+	// worker, with IgnoreBindErrors an address is skipped when any of its
+	// workers fails to bind.
+	ListenWorkers int
 	// TLSCertPath defines a path to .crt cert file.
 	TLSCertPath string
 	// TLSKeyPath defines a path to .key cert file
 	TLSKeyPath string
+	// TLSConfig is used as is when set, TLSCertPath/TLSKeyPath are ignored.
+	// NextProtos defaults to the HTTP/3 ALPN list when empty.
+	TLSConfig *tls.Config
+	// GetCertificate is used when TLSConfig is nil, it takes precedence over
+	// TLSCertPath/TLSKeyPath.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// CertReloadInterval enables polling TLSCertPath/TLSKeyPath for changes.
+	// Zero disables watching, ReloadCertificates can still be called.
+	CertReloadInterval time.Duration
+	// ReloadCertificatesOnSIGHUP reloads TLSCertPath/TLSKeyPath on SIGHUP.
+	ReloadCertificatesOnSIGHUP bool
+	// ClientCAs enables mTLS: client certificates are verified against this
+	// pool. Ignored when TLSConfig is set.
+	ClientCAs *x509.CertPool
+	// ClientCAPath is a PEM file of CA certificates, used instead of ClientCAs.
+	ClientCAPath string
+	// ClientAuth defaults to tls.RequireAndVerifyClientCert when ClientCAs or
+	// ClientCAPath is set.
+	ClientAuth tls.ClientAuthType
+	// CertificateHosts are the DNS names and IPs of the self-signed certificate
+	// generated when no TLS option is set, defaults to localhost.
+	CertificateHosts []string
+	// CertificateValidity of the self-signed certificate, must be less than
+	// MaxCertificateValidity. Defaults to DefaultCertificateValidity.
+	CertificateValidity time.Duration
+	// SessionTicketKeys shares the TLS session ticket keys between server
+	// instances, so clients resume sessions on any of them. Each instance
+	// generates its own keys when nil.
+	SessionTicketKeys SessionTicketKeyProvider
+	// SessionTicketKeyInterval is how often SessionTicketKeys is asked for
+	// the current keys. Defaults to DefaultSessionTicketKeyInterval.
+	SessionTicketKeyInterval time.Duration
+	// Enable0RTT accepts 0-RTT data from clients resuming a session.
+	Enable0RTT bool
+	// Allow0RTT decides whether a CONNECT request received as 0-RTT data is
+	// served. 0-RTT data can be replayed by an attacker, so such requests
+	// get 425 (Too Early) unless Allow0RTT returns true, the client repeats
+	// them after the handshake.
+	Allow0RTT func(req *http.Request) bool
 	// AllowedOrigins represents list of allowed origins to connect from.
 	AllowedOrigins []string
 
@@ -44,6 +104,45 @@ type ServerConfig struct {
 	MaxIdleTimeout time.Duration
 
 	KeepAlive bool
+
+	// AcceptQueueSize bounds the incoming streams per session waiting for
+	// AcceptStream/AcceptUniStream. Further streams are rejected. Defaults to
+	// DefaultAcceptQueueSize.
+	AcceptQueueSize int
+
+	// StreamHeaderTimeout bounds reading the stream type and session ID of
+	// incoming streams, slower streams are cancelled. Defaults to
+	// DefaultStreamHeaderTimeout.
+	StreamHeaderTimeout time.Duration
+
+	// MaxPendingStreams bounds the streams per connection that arrive before
+	// their session is established. Defaults to DefaultMaxPendingStreams.
+	MaxPendingStreams int
+
+	// MaxPendingDatagrams bounds the datagrams per connection that arrive
+	// before their session is established. Defaults to DefaultMaxPendingDatagrams.
+	MaxPendingDatagrams int
+
+	// PendingTimeout is how long streams and datagrams wait for their session,
+	// expired streams are rejected. Defaults to DefaultPendingTimeout.
+	PendingTimeout time.Duration
+
+	// MaxSessionsPerConnection is advertised to clients pooling sessions over
+	// one QUIC connection, further CONNECT requests get 429. Defaults to
+	// DefaultMaxSessionsPerConnection.
+	MaxSessionsPerConnection int
+
+	// LazyStreamHeader defers the header of locally opened streams to the
+	// first Write or Flush, so it does not go out in a packet of its own.
+	LazyStreamHeader bool
+
+	// OnMessage receives the datagrams of every session instead of
+	// WebTransport.ReceiveDatagram. It is set before the session starts, so no
+	// datagram is missed.
+	OnMessage func(transport *WebTransport, message []byte)
+
+	// OnClose is called once when a session is closed.
+	OnClose func(transport *WebTransport)
 }
 
 // WebTransportServer can handle WebTransport QUIC connections.
@@ -54,6 +153,16 @@ type ServerConfig struct {
 type WebTransportServer struct {
 	ServerConfig
 	Webtransport chan *WebTransport
+
+	mutex          sync.Mutex
+	certificates   *certificateLoader
+	selfSigned     *selfSignedCertificate
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	listeners      map[sessionListener]*listenerStats
+	sockets        map[sessionListener]*handoffConn
+	closed         bool
+	draining       bool
+	transports     map[*WebTransport]struct{}
 }
 
 func CreateWebTransportServer(config ServerConfig) *WebTransportServer {
@@ -66,35 +175,328 @@ func CreateWebTransportServer(config ServerConfig) *WebTransportServer {
 	if config.MaxIdleTimeout <= 0 {
 		config.MaxIdleTimeout = time.Duration(10 * time.Minute)
 	}
+	if config.AcceptQueueSize <= 0 {
+		config.AcceptQueueSize = DefaultAcceptQueueSize
+	}
+	if config.StreamHeaderTimeout <= 0 {
+		config.StreamHeaderTimeout = DefaultStreamHeaderTimeout
+	}
+	if config.MaxPendingStreams <= 0 {
+		config.MaxPendingStreams = DefaultMaxPendingStreams
+	}
+	if config.MaxPendingDatagrams <= 0 {
+		config.MaxPendingDatagrams = DefaultMaxPendingDatagrams
+	}
+	if config.PendingTimeout <= 0 {
+		config.PendingTimeout = DefaultPendingTimeout
+	}
+	if config.MaxSessionsPerConnection <= 0 {
+		config.MaxSessionsPerConnection = DefaultMaxSessionsPerConnection
+	}
+	if config.CertificateValidity <= 0 {
+		config.CertificateValidity = DefaultCertificateValidity
+	}
+	if config.ListenWorkers <= 0 {
+		config.ListenWorkers = 1
+	}
+	if config.SessionTicketKeyInterval <= 0 {
+		config.SessionTicketKeyInterval = DefaultSessionTicketKeyInterval
+	}
+	if len(config.CertificateHosts) == 0 {
+		config.CertificateHosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
 	return &WebTransportServer{
 		ServerConfig: config,
 		Webtransport: make(chan *WebTransport),
 	}
 }
 
-// Run server.
+// Run server on ListenAddr and ListenAddrs. Configuration errors are
+// returned before the sockets are bound. Run returns once every listener is
+// closed, after Close it returns ErrServerClosed.
 func (s *WebTransportServer) Run() error {
-	listener, err := quic.ListenAddr(s.ListenAddr, s.generateTLSConfig(), &quic.Config{
-		EnableDatagrams:      true,
-		HandshakeIdleTimeout: s.HandshakeIdleTimeout,
-		MaxIdleTimeout:       s.MaxIdleTimeout,
-		KeepAlive:            s.KeepAlive,
+	addrs := s.listenAddrs()
+	if len(addrs) == 0 {
+		return errors.New("listen address is required")
+	}
+	return s.serve(func(tlsConfig *tls.Config, quicConfig *quic.Config) ([]sessionListener, error) {
+		var listeners []sessionListener
+		var bindErr error
+		for _, addr := range addrs {
+			bound, err := s.listenWorkers(addr, tlsConfig, quicConfig)
+			if err == nil {
+				listeners = append(listeners, bound...)
+				continue
+			}
+			bindErr = fmt.Errorf("listen on %s: %w", addr, err)
+			if !s.IgnoreBindErrors {
+				for _, listener := range listeners {
+					s.closeListener(listener)
+				}
+				return nil, bindErr
+			}
+			log.Printf("[webtransport]skip listen address: %v", bindErr)
+		}
+		if len(listeners) == 0 {
+			return nil, bindErr
+		}
+		return listeners, nil
 	})
+}
+
+// listenWorkers binds addr ListenWorkers times. When one of them fails the
+// others are closed, so an address is either fully bound or not at all.
+func (s *WebTransportServer) listenWorkers(addr string, tlsConfig *tls.Config, quicConfig *quic.Config) ([]sessionListener, error) {
+	var listeners []sessionListener
+	for i := 0; i < s.ListenWorkers; i++ {
+		listener, err := s.listenAddr(addr, s.ListenWorkers > 1, tlsConfig, quicConfig)
+		if err != nil {
+			for _, listener := range listeners {
+				s.closeListener(listener)
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// closeListener closes a listener of Run that accept was not started for,
+// together with its socket.
+func (s *WebTransportServer) closeListener(listener sessionListener) {
+	listener.Close()
+	s.mutex.Lock()
+	socket := s.sockets[listener]
+	delete(s.sockets, listener)
+	s.mutex.Unlock()
+	if socket != nil {
+		socket.Close()
+	}
+}
+
+// listenAddrs returns ListenAddr followed by ListenAddrs, without duplicates.
+func (s *WebTransportServer) listenAddrs() []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range append([]string{s.ListenAddr}, s.ListenAddrs...) {
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// listenAddr binds addr, or takes over a socket a previous process handed
+// over for it, see Restart.
+func (s *WebTransportServer) listenAddr(addr string, reusePort bool, tlsConfig *tls.Config, quicConfig *quic.Config) (sessionListener, error) {
+	socket := inheritedSocket(addr)
+	if socket != nil {
+		log.Printf("[webtransport]took over the socket of %s", addr)
+	} else {
+		udp, err := listenUDP(addr, reusePort)
+		if err != nil {
+			return nil, err
+		}
+		socket = newHandoffConn(udp, addr)
+	}
+
+	var listener sessionListener
+	var err error
+	if s.Enable0RTT {
+		var early quic.EarlyListener
+		if early, err = quic.ListenEarly(socket, tlsConfig, quicConfig); err == nil {
+			listener = earlyListener{early}
+		}
+	} else {
+		listener, err = quic.Listen(socket, tlsConfig, quicConfig)
+	}
 	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	s.mutex.Lock()
+	if s.sockets == nil {
+		s.sockets = make(map[sessionListener]*handoffConn)
+	}
+	s.sockets[listener] = socket
+	s.mutex.Unlock()
+	return listener, nil
+}
+
+// Serve accepts connections on conn, a shared or inherited socket for
+// example. ListenAddr is ignored. conn is not closed by Close. After Close,
+// Serve returns ErrServerClosed.
+func (s *WebTransportServer) Serve(conn net.PacketConn) error {
+	return s.serve(func(tlsConfig *tls.Config, quicConfig *quic.Config) ([]sessionListener, error) {
+		if s.Enable0RTT {
+			listener, err := quic.ListenEarly(conn, tlsConfig, quicConfig)
+			if err != nil {
+				return nil, err
+			}
+			return []sessionListener{earlyListener{listener}}, nil
+		}
+		listener, err := quic.Listen(conn, tlsConfig, quicConfig)
+		if err != nil {
+			return nil, err
+		}
+		return []sessionListener{listener}, nil
+	})
+}
+
+// ServeListener accepts connections on l. Its TLS and QUIC configuration are
+// the caller's: NextProtos must contain the HTTP/3 ALPN and datagrams must be
+// enabled. The TLS options of ServerConfig are ignored. Close closes l. After
+// Close, ServeListener returns ErrServerClosed.
+func (s *WebTransportServer) ServeListener(l quic.EarlyListener) error {
+	return s.accept(earlyListener{l})
+}
+
+// Close stops every listener the server accepts on, quic-go closes the
+// connections of a listener with it. Use Shutdown to let them end first.
+func (s *WebTransportServer) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	listeners := s.listeners
+	s.listeners = nil
+	s.mutex.Unlock()
+
+	var err error
+	for listener := range listeners {
+		if closeErr := listener.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// serve sets up TLS, then accepts on the listeners returned by listen until
+// all of them are closed. The first error other than ErrServerClosed is returned.
+func (s *WebTransportServer) serve(listen func(*tls.Config, *quic.Config) ([]sessionListener, error)) error {
+	if err := s.validate(); err != nil {
 		return err
 	}
-	log.Printf("WebTransport Server listening on: %s", s.ListenAddr)
+	tlsConfig, err := s.generateTLSConfig()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	s.watchCertificates(done)
+	s.watchSessionTicketKeys(tlsConfig, done)
+
+	listeners, err := listen(tlsConfig, s.quicConfig())
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 1 {
+		return s.accept(listeners[0])
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener sessionListener) {
+			errs <- s.accept(listener)
+		}(listener)
+	}
+	err = ErrServerClosed
+	for range listeners {
+		if acceptErr := <-errs; acceptErr != ErrServerClosed {
+			log.Printf("[webtransport]listener stopped: %v", acceptErr)
+			if err == ErrServerClosed {
+				err = acceptErr
+			}
+		}
+	}
+	return err
+}
+
+// accept hands the connections of listener to handleSession until it is closed.
+func (s *WebTransportServer) accept(listener sessionListener) error {
+	stats := &listenerStats{addr: listener.Addr()}
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[sessionListener]*listenerStats)
+	}
+	s.listeners[listener] = stats
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, listener)
+		socket := s.sockets[listener]
+		delete(s.sockets, listener)
+		s.mutex.Unlock()
+		if socket != nil {
+			socket.Close()
+		}
+	}()
+
+	log.Printf("WebTransport Server listening on: %s", listener.Addr())
 	for {
 		sess, err := listener.Accept(context.Background())
 		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
 			return err
 		}
 		log.Printf("session accepted: %s", sess.RemoteAddr().String())
 
-		go s.handleSession(sess)
+		s.mutex.Lock()
+		draining := s.draining
+		socket := s.sockets[listener]
+		s.mutex.Unlock()
+		if draining {
+			_ = sess.CloseWithError(H3_NO_ERROR, "server shutting down")
+			continue
+		}
+		go s.handleSession(sess, stats, socket)
 	}
 }
 
+// sessionListener is a quic.Listener or a quic.EarlyListener.
+type sessionListener interface {
+	Accept(context.Context) (quic.Session, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// earlyListener hands out the sessions of a quic.EarlyListener before their
+// handshake is complete.
+type earlyListener struct {
+	quic.EarlyListener
+}
+
+func (l earlyListener) Accept(ctx context.Context) (quic.Session, error) {
+	return l.EarlyListener.Accept(ctx)
+}
+
+func (s *WebTransportServer) quicConfig() *quic.Config {
+	return &quic.Config{
+		EnableDatagrams:      true,
+		HandshakeIdleTimeout: s.HandshakeIdleTimeout,
+		MaxIdleTimeout:       s.MaxIdleTimeout,
+		KeepAlive:            s.KeepAlive,
+	}
+}
+
+// Limits of the streams and datagrams buffered before their session is established.
+const (
+	DefaultMaxPendingStreams   = 16
+	DefaultMaxPendingDatagrams = 64
+	DefaultPendingTimeout      = 3 * time.Second
+)
+
 // https://datatracker.ietf.org/doc/html/draft-ietf-masque-h3-datagram-05#section-9.1
 const H3_DATAGRAM_05 = 0xffd277
 
@@ -104,96 +506,172 @@ const ENABLE_CONNECT_PROTOCOL = 0x08
 // https://www.ietf.org/archive/id/draft-ietf-webtrans-http3-01.html#section-7.2
 const ENABLE_WEBTRNASPORT = 0x2b603742
 
-func (s *WebTransportServer) handleSession(sess quic.Session) {
-	str, err := sess.OpenUniStream()
-	if err != nil {
-		return
+// https://www.ietf.org/archive/id/draft-ietf-webtrans-http3-04.html#section-8.2
+const WEBTRANSPORT_MAX_SESSIONS = 0x2b603743
+
+// DefaultMaxSessionsPerConnection is the number of sessions a client may
+// open over one QUIC connection when ServerConfig.MaxSessionsPerConnection is
+// not set.
+const DefaultMaxSessionsPerConnection = 16
+
+func (s *WebTransportServer) handleSession(sess quic.Session, stats *listenerStats, socket *handoffConn) {
+	if socket != nil {
+		remote := sess.RemoteAddr().String()
+		socket.track(remote)
+		defer socket.untrack(remote)
 	}
-	// 发送Setting帧
-	buf := &bytes.Buffer{}
-	// stream type
-	quicvarint.Write(buf, 0)
-	(&h3.SettingsFrame{
-		Datagram: true,
-		Other: map[uint64]uint64{
-			uint64(H3_DATAGRAM_05):          uint64(1),
-			uint64(ENABLE_CONNECT_PROTOCOL): uint64(1),
-			uint64(ENABLE_WEBTRNASPORT):     uint64(1),
-		},
-	}).Write(buf)
-	str.Write(buf.Bytes())
-
-	settingsStream, err := sess.AcceptUniStream(context.Background())
-	if err != nil {
-		log.Println(err)
-		return
+	atomic.AddUint64(&stats.connections, 1)
+	atomic.AddInt64(&stats.activeConnections, 1)
+	defer atomic.AddInt64(&stats.activeConnections, -1)
+	newServerConn(s, sess, stats).serve()
+}
+
+// validate checks the server config without touching the network or the file system.
+func (s *WebTransportServer) validate() error {
+	if s.HandshakeIdleTimeout < 0 || s.MaxIdleTimeout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if s.ListenWorkers > 1 {
+		for _, addr := range s.listenAddrs() {
+			if _, port, err := net.SplitHostPort(addr); err == nil && (port == "" || port == "0") {
+				return fmt.Errorf("ListenWorkers needs a fixed port, %s binds a random port per worker", addr)
+			}
+		}
 	}
-	log.Printf("read settings from control stream id: %d", settingsStream.StreamID())
+	if s.ClientAuth >= tls.VerifyClientCertIfGiven && s.ClientCAs == nil && s.ClientCAPath == "" && s.TLSConfig == nil {
+		return errors.New("client certificate verification requires ClientCAs or ClientCAPath")
+	}
+	if s.ClientCAs != nil && s.ClientCAPath != "" {
+		return errors.New("ClientCAs and ClientCAPath are mutually exclusive")
+	}
+	if s.TLSConfig != nil {
+		if len(s.TLSConfig.Certificates) == 0 && s.TLSConfig.GetCertificate == nil && s.TLSConfig.GetConfigForClient == nil {
+			return errors.New("tls config has no certificate")
+		}
+		return nil
+	}
+	if s.GetCertificate != nil {
+		return nil
+	}
+	if (s.TLSCertPath == "") != (s.TLSKeyPath == "") {
+		return errors.New("TLSCertPath and TLSKeyPath must be set together")
+	}
+	if s.TLSCertPath == "" && s.CertificateValidity >= MaxCertificateValidity {
+		return fmt.Errorf("self-signed certificate validity must be less than %s", MaxCertificateValidity)
+	}
+	return nil
+}
 
-	requestStream, err := sess.AcceptStream(context.Background())
+func (s *WebTransportServer) generateTLSConfig() (*tls.Config, error) {
+	config, err := s.buildTLSConfig()
 	if err != nil {
-		log.Printf("request stream err: %v", err)
-		return
+		return nil, err
 	}
-	log.Printf("request stream accepted: %d", requestStream.StreamID())
+	if s.SessionTicketKeys != nil {
+		if err := setSessionTicketKeys(config, s.SessionTicketKeys); err != nil {
+			return nil, fmt.Errorf("load session ticket keys: %w", err)
+		}
+	}
+	return config, nil
+}
 
-	ctx := requestStream.Context()
-	ctx = context.WithValue(ctx, http3.ServerContextKey, s)
-	ctx = context.WithValue(ctx, http.LocalAddrContextKey, sess.LocalAddr())
-	frame, err := h3.ParseNextFrame(requestStream)
-	if err != nil {
-		log.Printf("request stream ParseNextFrame err: %v", err)
-		return
+func (s *WebTransportServer) buildTLSConfig() (*tls.Config, error) {
+	if s.TLSConfig != nil {
+		config := s.TLSConfig.Clone()
+		if len(config.NextProtos) == 0 {
+			config.NextProtos = nextProtos
+		}
+		return config, nil
 	}
-	hf, ok := frame.(*h3.HeadersFrame)
-	if !ok {
-		log.Println("request stream got not HeadersFrame")
-		return
+	config := &tls.Config{
+		NextProtos: nextProtos,
 	}
-	headerBlock := make([]byte, hf.Length)
-	if _, err := io.ReadFull(requestStream, headerBlock); err != nil {
-		log.Printf("request stream read headerBlock err: %v", err)
+	if err := s.configureClientAuth(config); err != nil {
+		return nil, err
 	}
-	decoder := qpack.NewDecoder(nil)
-	hfs, err := decoder.DecodeFull(headerBlock)
-	if err != nil {
-		log.Printf("request stream decoder err: %v", err)
-		return
+	if s.GetCertificate != nil {
+		config.GetCertificate = s.GetCertificate
+		return config, nil
 	}
-	req, err := h3.RequestFromHeaders(hfs)
+	if s.TLSCertPath == "" {
+		selfSigned, err := newSelfSignedCertificate(s.CertificateHosts, s.CertificateValidity)
+		if err != nil {
+			return nil, err
+		}
+		s.mutex.Lock()
+		s.selfSigned = selfSigned
+		s.getCertificate = selfSigned.getCertificate
+		s.mutex.Unlock()
+		log.Printf("serving self-signed certificate, sha-256: %s", base64.StdEncoding.EncodeToString(s.CertificateHash()))
+		config.GetCertificate = selfSigned.getCertificate
+		return config, nil
+	}
+	certificates, err := newCertificateLoader(s.TLSCertPath, s.TLSKeyPath)
 	if err != nil {
-		log.Printf("request stream RequestFromHeaders err: %v", err)
-		return
+		return nil, err
 	}
+	s.mutex.Lock()
+	s.certificates = certificates
+	s.getCertificate = certificates.getCertificate
+	s.mutex.Unlock()
+	config.GetCertificate = certificates.getCertificate
+	return config, nil
+}
 
-	req.RemoteAddr = sess.RemoteAddr().String()
-	req = req.WithContext(ctx)
-	r := h3.NewResponseWriter(requestStream)
-	r.Header().Add("sec-webtransport-http3-draft", "draft02")
+func (s *WebTransportServer) configureClientAuth(config *tls.Config) error {
+	config.ClientAuth = s.ClientAuth
+	config.ClientCAs = s.ClientCAs
+	if s.ClientCAPath != "" {
+		pem, err := os.ReadFile(s.ClientCAPath)
+		if err != nil {
+			return fmt.Errorf("load client CA: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("load client CA: no certificate found in %s", s.ClientCAPath)
+		}
+	}
+	if config.ClientCAs != nil && config.ClientAuth == tls.NoClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
 
-	// https://datatracker.ietf.org/doc/draft-ietf-webtrans-http3/ 3.3.  Creating a New Session
-	if req.Method == "CONNECT" && req.Proto == "webtransport" && (req.URL.Path == s.Path || s.Path == "") {
-		r.WriteHeader(200)
-		r.Flush()
-	} else {
-		r.WriteHeader(404)
-		r.Flush()
+// watchCertificates starts the self-signed rotation, the file watcher and the
+// SIGHUP handler, all stop when done is closed.
+func (s *WebTransportServer) watchCertificates(done <-chan struct{}) {
+	s.mutex.Lock()
+	certificates := s.certificates
+	selfSigned := s.selfSigned
+	s.mutex.Unlock()
+	if selfSigned != nil {
+		go selfSigned.watch(done)
+	}
+	if certificates == nil {
 		return
 	}
 
-	transport := createWebTransport(sess, req, requestStream, settingsStream)
-
-	s.Webtransport <- transport
-
-}
-
-func (s *WebTransportServer) generateTLSConfig() *tls.Config {
-	cert, err := tls.LoadX509KeyPair(s.TLSCertPath, s.TLSKeyPath)
-	if err != nil {
-		log.Fatal(err)
+	if s.CertReloadInterval > 0 {
+		go certificates.watch(s.CertReloadInterval, done)
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"h3", "h3-32", "h3-31", "h3-30", "h3-29"},
+
+	if s.ReloadCertificatesOnSIGHUP {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		go func() {
+			defer signal.Stop(signals)
+			for {
+				select {
+				case <-done:
+					return
+				case <-signals:
+					if err := certificates.reload(); err != nil {
+						log.Printf("certificate reload on SIGHUP failed, keep serving the current one: %v", err)
+						continue
+					}
+					log.Printf("certificate reloaded on SIGHUP from %s", s.TLSCertPath)
+				}
+			}
+		}()
 	}
 }
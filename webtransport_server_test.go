@@ -0,0 +1,24 @@
+package webtransport
+
+import "testing"
+
+func TestValidateListenWorkersPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ServerConfig
+		wantErr bool
+	}{
+		{"one worker on port 0", ServerConfig{ListenAddr: "127.0.0.1:0"}, false},
+		{"workers on a fixed port", ServerConfig{ListenAddr: ":4433", ListenWorkers: 4}, false},
+		{"workers on port 0", ServerConfig{ListenAddr: "127.0.0.1:0", ListenWorkers: 4}, true},
+		{"workers on an extra port 0", ServerConfig{ListenAddr: ":4433", ListenAddrs: []string{"[::1]:0"}, ListenWorkers: 2}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CreateWebTransportServer(test.config).validate()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("validate = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
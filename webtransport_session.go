@@ -0,0 +1,392 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// Session is a WebTransport session, implemented by the server side
+// WebTransport and by WebTransportClient, so application code can run on
+// either side.
+type Session interface {
+	// SessionID returns the stream ID of the CONNECT request.
+	SessionID() uint64
+	State() SessionState
+
+	// Context is cancelled once the session is closed, see Cause.
+	Context() context.Context
+	SetValue(key, value interface{})
+	Value(key interface{}) interface{}
+
+	AcceptStream(ctx context.Context) (*Stream, error)
+	AcceptUniStream(ctx context.Context) (*ReceiveStream, error)
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+
+	CreateStream() (*Stream, error)
+	OpenStreamSync(ctx context.Context) (*Stream, error)
+	CreateUniStream() (*SendStream, error)
+	OpenUniStreamSync(ctx context.Context) (*SendStream, error)
+	SendMessage(message []byte) error
+
+	StreamStats() StreamStats
+	Close(code quic.ApplicationErrorCode, message string) error
+}
+
+var (
+	_ Session = (*WebTransport)(nil)
+	_ Session = (*WebTransportClient)(nil)
+)
+
+// webtransportSession implements Session on top of a QUIC connection. The
+// connection side feeds it the streams and datagrams of the session.
+type webtransportSession struct {
+	session quic.Session
+
+	// stream ID of the CONNECT request
+	sessionId uint64
+
+	connectStream quic.Stream
+
+	// Incoming bidirectional HTTP/3 streams (e.g. WebTransport)
+	streams chan quic.Stream
+
+	// Incoming unidirectional HTTP/3 streams (e.g. WebTransport)
+	uniStreams chan quic.ReceiveStream
+
+	datagrams chan []byte
+
+	lazyStreamHeader bool
+
+	stats *streamStats
+	state *sessionState
+
+	// onMessage receives datagrams instead of ReceiveDatagram when set
+	onMessage func([]byte)
+	// onClose runs once after the session is closed
+	onClose func()
+	// release runs once an open session ends, with the code it was closed
+	// with. The client side uses it to give up its QUIC connection.
+	release func(code quic.ApplicationErrorCode, message string) error
+
+	// outer is the WebTransport or WebTransportClient embedding the session
+	outer  Session
+	ctx    context.Context
+	cancel context.CancelFunc
+	values sync.Map
+}
+
+func newWebTransportSession(state SessionState, acceptQueueSize int, stats *streamStats) *webtransportSession {
+	if acceptQueueSize <= 0 {
+		acceptQueueSize = DefaultAcceptQueueSize
+	}
+	s := &webtransportSession{
+		streams:    make(chan quic.Stream, acceptQueueSize),
+		uniStreams: make(chan quic.ReceiveStream, acceptQueueSize),
+		datagrams:  make(chan []byte, datagramQueueSize),
+		stats:      stats,
+		state:      newSessionState(state),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = &sessionContext{Context: ctx, session: s}
+	s.cancel = cancel
+	return s
+}
+
+// parseDatagram splits a datagram into the session ID and the payload.
+func parseDatagram(msg []byte) (uint64, []byte, error) {
+	buf := bytes.NewBuffer(msg)
+	quarterId, err := quicvarint.Read(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	return quarterId * 4, buf.Bytes(), nil
+}
+
+// readConnectStream closes the session when the CONNECT stream ends, with the
+// code and reason of the CLOSE_WEBTRANSPORT_SESSION capsule the peer sent.
+func (s *webtransportSession) readConnectStream() {
+	r := quicvarint.NewReader(s.connectStream)
+	var closeCause *SessionError
+	for {
+		cause, err := readCapsule(r)
+		if err != nil {
+			if err == io.EOF && closeCause != nil {
+				s.close(closeCause)
+			} else {
+				s.close(sessionError(err))
+			}
+			return
+		}
+		if cause != nil {
+			closeCause = cause
+		}
+	}
+}
+
+// readCapsule reads a capsule of the CONNECT stream. It returns the close
+// cause of a CLOSE_WEBTRANSPORT_SESSION capsule, other capsules are skipped.
+func readCapsule(r quicvarint.Reader) (*SessionError, error) {
+	capsuleType, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	length, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if capsuleType != closeWebTransportSessionCapsule || length < 4 || length > 4+maxCloseReasonLength {
+		log.Printf("[webtransport]skip capsule of type %#x on the connect stream, length %d", capsuleType, length)
+		if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return &SessionError{
+		Code:   quic.ApplicationErrorCode(binary.BigEndian.Uint32(payload)),
+		Reason: string(payload[4:]),
+		Remote: true,
+	}, nil
+}
+
+// closeCapsule encodes a CLOSE_WEBTRANSPORT_SESSION capsule, the code is sent
+// as 32 bits and the reason is cut to maxCloseReasonLength bytes.
+func closeCapsule(code quic.ApplicationErrorCode, reason string) []byte {
+	if len(reason) > maxCloseReasonLength {
+		reason = reason[:maxCloseReasonLength]
+	}
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, closeWebTransportSessionCapsule)
+	quicvarint.Write(buf, uint64(4+len(reason)))
+	var codeBytes [4]byte
+	binary.BigEndian.PutUint32(codeBytes[:], uint32(code))
+	buf.Write(codeBytes[:])
+	buf.WriteString(reason)
+	return buf.Bytes()
+}
+
+// handleStream queues an incoming bidirectional stream of the session.
+func (s *webtransportSession) handleStream(stream quic.Stream) {
+	log.Printf("[AcceptStream.WebTransportStream]stream accepted streamId: %d, sessionId: %d", stream.StreamID(), s.sessionId)
+
+	select {
+	case s.streams <- stream:
+	case <-s.state.done:
+		rejectStream(stream, WEBTRANSPORT_BUFFERED_STREAM_REJECTED)
+	default:
+		log.Printf("[AcceptStream.WebTransportStream]accept queue is full, reject streamId: %d", stream.StreamID())
+		atomic.AddUint64(&s.stats.queueFull, 1)
+		rejectStream(stream, WEBTRANSPORT_BUFFERED_STREAM_REJECTED)
+	}
+}
+
+// handleUniStream queues an incoming unidirectional stream of the session.
+func (s *webtransportSession) handleUniStream(stream quic.ReceiveStream) {
+	log.Printf("[AcceptStream.WebTransportUniStream]receiveStream accepted streamId: %d, sessionId: %d", stream.StreamID(), s.sessionId)
+
+	select {
+	case s.uniStreams <- stream:
+	case <-s.state.done:
+		rejectStream(stream, WEBTRANSPORT_BUFFERED_STREAM_REJECTED)
+	default:
+		log.Printf("[AcceptStream.WebTransportUniStream]accept queue is full, reject streamId: %d", stream.StreamID())
+		atomic.AddUint64(&s.stats.queueFull, 1)
+		rejectStream(stream, WEBTRANSPORT_BUFFERED_STREAM_REJECTED)
+	}
+}
+
+// handleDatagram delivers a datagram payload without the session ID.
+func (s *webtransportSession) handleDatagram(msg []byte) {
+	if s.onMessage != nil {
+		s.onMessage(msg)
+		return
+	}
+	select {
+	case s.datagrams <- msg:
+	default:
+		log.Printf("[webtransport]datagram queue is full, drop datagram")
+	}
+}
+
+// SessionID returns the stream ID of the CONNECT request.
+func (s *webtransportSession) SessionID() uint64 {
+	return s.sessionId
+}
+
+// State returns the lifecycle state of the session.
+func (s *webtransportSession) State() SessionState {
+	return s.state.get()
+}
+
+// AcceptStream returns the next bidirectional stream opened by the peer.
+func (s *webtransportSession) AcceptStream(ctx context.Context) (*Stream, error) {
+	select {
+	case stream := <-s.streams:
+		return newStream(stream, s.sessionId), nil
+	case <-s.state.done:
+		return nil, s.state.err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AcceptUniStream returns the next unidirectional stream opened by the peer.
+func (s *webtransportSession) AcceptUniStream(ctx context.Context) (*ReceiveStream, error) {
+	select {
+	case stream := <-s.uniStreams:
+		return newReceiveStream(stream, s.sessionId), nil
+	case <-s.state.done:
+		return nil, s.state.err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ReceiveDatagram returns the next datagram payload without the session ID.
+// It is not used when an OnMessage callback is configured.
+func (s *webtransportSession) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case msg := <-s.datagrams:
+		return msg, nil
+	case <-s.state.done:
+		return nil, s.state.err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// CreateStream opens a bidirectional stream and writes the WebTransport
+// stream header. It fails immediately when the peer's stream limit is reached.
+func (s *webtransportSession) CreateStream() (*Stream, error) {
+	if err := s.state.err(); err != nil {
+		return nil, err
+	}
+
+	stream, err := s.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return newOutgoingStream(stream, s.sessionId, s.lazyStreamHeader)
+}
+
+// OpenStreamSync is CreateStream waiting for stream credit from the peer
+// until ctx is done.
+func (s *webtransportSession) OpenStreamSync(ctx context.Context) (*Stream, error) {
+	if err := s.state.err(); err != nil {
+		return nil, err
+	}
+
+	stream, err := s.session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newOutgoingStream(stream, s.sessionId, s.lazyStreamHeader)
+}
+
+// CreateUniStream opens a unidirectional stream and writes the WebTransport
+// stream header. It fails immediately when the peer's stream limit is reached.
+func (s *webtransportSession) CreateUniStream() (*SendStream, error) {
+	if err := s.state.err(); err != nil {
+		return nil, err
+	}
+
+	stream, err := s.session.OpenUniStream()
+	if err != nil {
+		return nil, err
+	}
+	return newOutgoingSendStream(stream, s.sessionId, s.lazyStreamHeader)
+}
+
+// OpenUniStreamSync is CreateUniStream waiting for stream credit from the
+// peer until ctx is done.
+func (s *webtransportSession) OpenUniStreamSync(ctx context.Context) (*SendStream, error) {
+	if err := s.state.err(); err != nil {
+		return nil, err
+	}
+
+	stream, err := s.session.OpenUniStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newOutgoingSendStream(stream, s.sessionId, s.lazyStreamHeader)
+}
+
+// SendMessage sends a datagram prefixed with the session ID.
+func (s *webtransportSession) SendMessage(message []byte) error {
+	if err := s.state.err(); err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, quarterStreamId(s.sessionId))
+	buf.Write(message)
+	return s.session.SendMessage(buf.Bytes())
+}
+
+// StreamStats returns the counts of incoming streams rejected on the
+// session's QUIC connection.
+func (s *webtransportSession) StreamStats() StreamStats {
+	return s.stats.snapshot()
+}
+
+// close ends the session with cause, only the first cause is kept. It is safe
+// to call from any goroutine.
+func (s *webtransportSession) close(cause *SessionError) {
+	previous, ok := s.state.drain(cause)
+	if !ok {
+		return
+	}
+	if s.release != nil && previous == StateOpen {
+		_ = s.release(H3_NO_ERROR, "")
+	}
+	s.finish()
+}
+
+// finish releases a draining session and runs onClose.
+func (s *webtransportSession) finish() {
+	s.state.finish()
+	s.cancel()
+
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+// Close ends the session by closing its CONNECT stream, blocked calls return
+// a *SessionError with code and message. The peer gets them in a
+// CLOSE_WEBTRANSPORT_SESSION capsule, with the code cut to 32 bits. On the
+// client side the QUIC connection is closed too unless other sessions or a
+// pool use it. Close is idempotent and safe to call from any goroutine, a
+// session that is still connecting fails to open.
+func (s *webtransportSession) Close(code quic.ApplicationErrorCode, message string) error {
+	previous, ok := s.state.drain(&SessionError{Code: code, Reason: message})
+	if !ok {
+		return nil
+	}
+	var err error
+	if previous == StateOpen {
+		s.connectStream.CancelRead(H3_NO_ERROR)
+		_, err = s.connectStream.Write(closeCapsule(code, message))
+		if closeErr := s.connectStream.Close(); err == nil {
+			err = closeErr
+		}
+		if s.release != nil {
+			if releaseErr := s.release(code, message); err == nil {
+				err = releaseErr
+			}
+		}
+	}
+	s.finish()
+	return err
+}
@@ -0,0 +1,219 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// startTestServer serves on a loopback socket with a self-signed certificate
+// and hands every session to handle, it returns the server address.
+func startTestServer(t *testing.T, config ServerConfig, handle func(*WebTransport)) (*WebTransportServer, string) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := CreateWebTransportServer(config)
+	go func() {
+		for transport := range server.Webtransport {
+			if handle != nil {
+				go handle(transport)
+			}
+		}
+	}()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(conn)
+	}()
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("Serve = %v", err)
+		}
+		conn.Close()
+	})
+	return server, conn.LocalAddr().String()
+}
+
+func testClientConfig(addr string) ClientConfig {
+	return ClientConfig{
+		RemoteAddr:           addr,
+		InsecureSkipVerify:   true,
+		HandshakeIdleTimeout: 5 * time.Second,
+	}
+}
+
+func TestCloseCapsuleRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       uint64
+		reason     string
+		wantCode   uint64
+		wantReason string
+	}{
+		{"empty", 0, "", 0, ""},
+		{"code and reason", 42, "bye", 42, "bye"},
+		{"code cut to 32 bits", 1<<32 + 7, "", 7, ""},
+		{"reason cut", 1, strings.Repeat("x", maxCloseReasonLength+10), 1, strings.Repeat("x", maxCloseReasonLength)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// an unknown capsule before the close capsule is skipped
+			var stream bytes.Buffer
+			quicvarint.Write(&stream, 0x17)
+			quicvarint.Write(&stream, 3)
+			stream.WriteString("abc")
+			stream.Write(closeCapsule(quic.ApplicationErrorCode(test.code), test.reason))
+			r := quicvarint.NewReader(&stream)
+
+			cause, err := readCapsule(r)
+			if err != nil || cause != nil {
+				t.Fatalf("unknown capsule = %v, %v", cause, err)
+			}
+			cause, err = readCapsule(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uint64(cause.Code) != test.wantCode || cause.Reason != test.wantReason || !cause.Remote {
+				t.Fatalf("cause = %d %q remote %v", cause.Code, cause.Reason, cause.Remote)
+			}
+			if _, err := readCapsule(r); err != io.EOF {
+				t.Fatalf("after the capsules: %v", err)
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSessionOpenCloseStress opens sessions over loopback and closes them
+// from both sides at once, every session must end on both sides.
+func TestSessionOpenCloseStress(t *testing.T) {
+	server, addr := startTestServer(t, ServerConfig{}, func(transport *WebTransport) {
+		if transport.SessionID()%8 == 0 {
+			transport.Close(H3_NO_ERROR, "server close")
+		}
+		<-transport.Context().Done()
+	})
+
+	const sessions = 16
+	var connected int32
+	var wg sync.WaitGroup
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			client := CreateWebTransportClient(testClientConfig(addr))
+			if i%4 == 0 {
+				// closed while connecting
+				go client.Close(H3_NO_ERROR, "")
+			}
+			if err := client.Connect(ctx); err != nil {
+				client.Close(H3_NO_ERROR, "")
+				return
+			}
+			atomic.AddInt32(&connected, 1)
+
+			var closers sync.WaitGroup
+			closers.Add(2)
+			go func() {
+				defer closers.Done()
+				client.Close(H3_NO_ERROR, "client close")
+			}()
+			go func() {
+				defer closers.Done()
+				client.close(&SessionError{Reason: "local"})
+			}()
+			closers.Wait()
+
+			select {
+			case <-client.Context().Done():
+			case <-ctx.Done():
+				t.Errorf("session %d did not end", client.SessionID())
+			}
+			if state := client.State(); state != StateClosed {
+				t.Errorf("client state = %s", state)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&connected); n < sessions/2 {
+		t.Fatalf("only %d sessions connected", n)
+	}
+
+	waitFor(t, 5*time.Second, func() bool {
+		return len(server.Sessions()) == 0
+	})
+}
+
+// TestCloseCauseReachesPeer closes the session on one side, the other side
+// ends with the same code and reason.
+func TestCloseCauseReachesPeer(t *testing.T) {
+	serverCauses := make(chan error, 1)
+	_, addr := startTestServer(t, ServerConfig{}, func(transport *WebTransport) {
+		if transport.Req.URL.Path == "/close" {
+			transport.Close(42, "server bye")
+			return
+		}
+		<-transport.Context().Done()
+		serverCauses <- Cause(transport.Context())
+	})
+	connect := func(path string) *WebTransportClient {
+		config := testClientConfig(addr)
+		config.Path = path
+		client := CreateWebTransportClient(config)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := client.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	checkCause := func(err error, code quic.ApplicationErrorCode, reason string) {
+		t.Helper()
+		var sessionErr *SessionError
+		if !errors.As(err, &sessionErr) || !sessionErr.Remote || sessionErr.Code != code || sessionErr.Reason != reason {
+			t.Fatalf("cause = %v, want remote code %d %q", err, code, reason)
+		}
+	}
+
+	client := connect("/close")
+	select {
+	case <-client.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server close did not reach the client")
+	}
+	checkCause(Cause(client.Context()), 42, "server bye")
+
+	client = connect("/")
+	client.Close(7, "client bye")
+	select {
+	case err := <-serverCauses:
+		checkCause(err, 7, "client bye")
+	case <-time.After(5 * time.Second):
+		t.Fatal("client close did not reach the server")
+	}
+}
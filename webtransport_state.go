@@ -0,0 +1,112 @@
+package webtransport
+
+import (
+	"sync"
+)
+
+// SessionState is the lifecycle state of a session, shared by the server and
+// the client side.
+type SessionState int
+
+const (
+	// StateConnecting is a client session before Connect succeeded.
+	StateConnecting SessionState = iota
+	// StateOpen is an established session.
+	StateOpen
+	// StateDraining is a session being closed, new calls fail with the close
+	// cause while blocked calls are released once it is closed.
+	StateDraining
+	// StateClosed is a session that ended, see SessionError for the cause.
+	StateClosed
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateDraining:
+		return "draining"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// sessionState guards the lifecycle of a session. All transitions happen
+// under the mutex and only move forward: connecting, open, draining, closed.
+// done is closed exactly once, when the session reaches StateClosed.
+type sessionState struct {
+	mutex    sync.Mutex
+	state    SessionState
+	closeErr error
+	done     chan struct{}
+}
+
+func newSessionState(state SessionState) *sessionState {
+	return &sessionState{
+		state: state,
+		done:  make(chan struct{}),
+	}
+}
+
+func (s *sessionState) get() SessionState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+// open moves a connecting session to open, it fails when the session was
+// closed in the meantime.
+func (s *sessionState) open() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.state != StateConnecting {
+		return false
+	}
+	s.state = StateOpen
+	return true
+}
+
+// drain starts closing the session with cause. It returns the state the
+// session was in and false when it is already draining or closed, so the
+// caller that gets true is the only one tearing the session down.
+func (s *sessionState) drain(cause error) (SessionState, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := s.state
+	if previous >= StateDraining {
+		return previous, false
+	}
+	s.state = StateDraining
+	s.closeErr = cause
+	return previous, true
+}
+
+// finish moves a draining session to closed and releases blocked calls.
+func (s *sessionState) finish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.state != StateDraining {
+		return
+	}
+	s.state = StateClosed
+	close(s.done)
+}
+
+// err returns nil for an open session, ErrNotConnected before it is open and
+// the close cause once it is draining or closed.
+func (s *sessionState) err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch s.state {
+	case StateOpen:
+		return nil
+	case StateConnecting:
+		return ErrNotConnected
+	default:
+		return s.closeErr
+	}
+}
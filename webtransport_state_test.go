@@ -0,0 +1,119 @@
+package webtransport
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// nopStream stands in for the CONNECT stream of a session without a connection.
+type nopStream struct {
+	quic.Stream
+}
+
+func (nopStream) CancelRead(quic.StreamErrorCode) {}
+
+func (nopStream) Write(p []byte) (int, error) { return len(p), nil }
+
+func (nopStream) Close() error { return nil }
+
+func TestSessionStateTransitions(t *testing.T) {
+	state := newSessionState(StateConnecting)
+	if err := state.err(); err != ErrNotConnected {
+		t.Fatalf("connecting err = %v", err)
+	}
+	if !state.open() || state.get() != StateOpen || state.err() != nil {
+		t.Fatalf("open failed, state %s", state.get())
+	}
+	if state.open() {
+		t.Fatal("open succeeded twice")
+	}
+	cause := &SessionError{Code: 1}
+	if previous, ok := state.drain(cause); !ok || previous != StateOpen {
+		t.Fatalf("drain = %s, %v", previous, ok)
+	}
+	if _, ok := state.drain(&SessionError{Code: 2}); ok {
+		t.Fatal("drain succeeded twice")
+	}
+	if state.err() != cause {
+		t.Fatalf("draining err = %v", state.err())
+	}
+	select {
+	case <-state.done:
+		t.Fatal("done closed while draining")
+	default:
+	}
+	state.finish()
+	state.finish()
+	if state.get() != StateClosed || state.err() != cause {
+		t.Fatalf("closed state %s err %v", state.get(), state.err())
+	}
+	<-state.done
+}
+
+// TestSessionConcurrentOpenClose races Close, close(cause) and state.open() on
+// one session. Exactly one of the closes wins, onClose runs once, done is
+// closed and err() reports the winning cause.
+func TestSessionConcurrentOpenClose(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		session := newWebTransportSession(StateConnecting, 0, &streamStats{})
+		session.connectStream = nopStream{}
+		var onClose int32
+		session.onClose = func() {
+			atomic.AddInt32(&onClose, 1)
+		}
+
+		var wg sync.WaitGroup
+		var opened int32
+		closeCause := &SessionError{Code: 1, Reason: "close"}
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_ = session.Close(2, "Close")
+		}()
+		go func() {
+			defer wg.Done()
+			session.close(closeCause)
+		}()
+		go func() {
+			defer wg.Done()
+			if session.state.open() {
+				atomic.StoreInt32(&opened, 1)
+			}
+		}()
+		wg.Wait()
+
+		select {
+		case <-session.state.done:
+		default:
+			t.Fatal("done not closed")
+		}
+		select {
+		case <-session.Context().Done():
+		default:
+			t.Fatal("context not cancelled")
+		}
+		if n := atomic.LoadInt32(&onClose); n != 1 {
+			t.Fatalf("onClose ran %d times", n)
+		}
+		if state := session.State(); state != StateClosed {
+			t.Fatalf("state = %s", state)
+		}
+		var sessionErr *SessionError
+		if err := session.state.err(); !errors.As(err, &sessionErr) {
+			t.Fatalf("err = %v", err)
+		}
+		if sessionErr != closeCause && sessionErr.Reason != "Close" {
+			t.Fatalf("err = %v is neither cause", sessionErr)
+		}
+		if session.state.open() {
+			t.Fatal("closed session opened")
+		}
+		if _, err := session.CreateStream(); !errors.Is(err, ErrSessionClosed) {
+			t.Fatalf("CreateStream on a closed session = %v", err)
+		}
+	}
+}
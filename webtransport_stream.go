@@ -0,0 +1,294 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// StreamErrorCode is a WebTransport application error code, carried in
+// RESET_STREAM and STOP_SENDING mapped into the HTTP/3 error code space.
+type StreamErrorCode uint8
+
+// https://www.ietf.org/archive/id/draft-ietf-webtrans-http3-02.html#section-4.3
+const (
+	firstErrorCode = 0x52e4a40fa8db
+	lastErrorCode  = 0x52e4a40fa9e2
+)
+
+func webtransportCodeToHTTPCode(n StreamErrorCode) quic.StreamErrorCode {
+	return quic.StreamErrorCode(firstErrorCode + uint64(n) + uint64(n)/0x1e)
+}
+
+func httpCodeToWebtransportCode(h quic.StreamErrorCode) (StreamErrorCode, error) {
+	if h < firstErrorCode || h > lastErrorCode {
+		return 0, fmt.Errorf("error code 0x%x outside of the WebTransport range", uint64(h))
+	}
+	if (h-0x21)%0x1f == 0 {
+		return 0, fmt.Errorf("error code 0x%x is reserved", uint64(h))
+	}
+	shifted := uint64(h - firstErrorCode)
+	return StreamErrorCode(shifted - shifted/0x1f), nil
+}
+
+// StreamError is returned by stream reads and writes after the stream was
+// reset or stopped, locally or by the peer.
+type StreamError struct {
+	Code   StreamErrorCode
+	Remote bool
+}
+
+func (e *StreamError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("webtransport: stream canceled by peer with error code %d", e.Code)
+	}
+	return fmt.Sprintf("webtransport: stream canceled with error code %d", e.Code)
+}
+
+func (e *StreamError) Is(target error) bool {
+	_, ok := target.(*StreamError)
+	return ok
+}
+
+// streamCancel remembers a local cancellation, quic-go only reports it with a
+// plain error.
+type streamCancel struct {
+	mutex    sync.Mutex
+	canceled bool
+	code     StreamErrorCode
+}
+
+func (c *streamCancel) cancel(code StreamErrorCode) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.canceled {
+		c.canceled = true
+		c.code = code
+	}
+}
+
+// convert maps errors of the underlying QUIC stream to *StreamError.
+func (c *streamCancel) convert(err error) error {
+	if err == nil {
+		return nil
+	}
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		code, err := httpCodeToWebtransportCode(streamErr.ErrorCode)
+		if err != nil {
+			// codes outside of the WebTransport range are reported as 0
+			code = 0
+		}
+		return &StreamError{Code: code, Remote: true}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.canceled {
+		return &StreamError{Code: c.code}
+	}
+	return err
+}
+
+// writeStreamHeader writes the stream type and session ID of an outgoing
+// stream. A stream that cannot carry its header is cancelled.
+func writeStreamHeader(stream quic.SendStream, streamType uint64, sessionId uint64) error {
+	if _, err := stream.Write(encodeStreamHeader(streamType, sessionId)); err != nil {
+		stream.CancelWrite(H3_INTERNAL_ERROR)
+		if receiveStream, ok := stream.(quic.ReceiveStream); ok {
+			receiveStream.CancelRead(H3_INTERNAL_ERROR)
+		}
+		return err
+	}
+	return nil
+}
+
+// encodeStreamHeader returns the stream type and session ID of an outgoing stream.
+func encodeStreamHeader(streamType uint64, sessionId uint64) []byte {
+	buf := &bytes.Buffer{}
+	quicvarint.Write(buf, streamType)
+	quicvarint.Write(buf, sessionId)
+	return buf.Bytes()
+}
+
+// newOutgoingStream writes the header of a stream opened locally, or defers it
+// to the first write when lazy is set.
+func newOutgoingStream(str quic.Stream, sessionId uint64, lazy bool) (*Stream, error) {
+	if lazy {
+		stream := newStream(str, sessionId)
+		stream.SendStream.header = encodeStreamHeader(WebTransportStream, sessionId)
+		return stream, nil
+	}
+	if err := writeStreamHeader(str, WebTransportStream, sessionId); err != nil {
+		return nil, err
+	}
+	return newStream(str, sessionId), nil
+}
+
+// newOutgoingSendStream is newOutgoingStream for unidirectional streams.
+func newOutgoingSendStream(str quic.SendStream, sessionId uint64, lazy bool) (*SendStream, error) {
+	if lazy {
+		stream := newSendStream(str, sessionId)
+		stream.header = encodeStreamHeader(WebTransportUniStream, sessionId)
+		return stream, nil
+	}
+	if err := writeStreamHeader(str, WebTransportUniStream, sessionId); err != nil {
+		return nil, err
+	}
+	return newSendStream(str, sessionId), nil
+}
+
+// SendStream is the sending side of a WebTransport stream.
+type SendStream struct {
+	str       quic.SendStream
+	sessionId uint64
+	cancel    streamCancel
+
+	// header not written yet, it goes out with the first Write or Flush
+	headerMutex sync.Mutex
+	header      []byte
+}
+
+func newSendStream(str quic.SendStream, sessionId uint64) *SendStream {
+	return &SendStream{str: str, sessionId: sessionId}
+}
+
+// SessionID returns the ID of the session the stream belongs to.
+func (s *SendStream) SessionID() uint64 {
+	return s.sessionId
+}
+
+func (s *SendStream) StreamID() quic.StreamID {
+	return s.str.StreamID()
+}
+
+func (s *SendStream) Write(p []byte) (int, error) {
+	s.headerMutex.Lock()
+	if s.header == nil {
+		s.headerMutex.Unlock()
+		n, err := s.str.Write(p)
+		return n, s.cancel.convert(err)
+	}
+	defer s.headerMutex.Unlock()
+
+	// coalesce the pending header with the first payload into one write
+	buf := make([]byte, 0, len(s.header)+len(p))
+	buf = append(buf, s.header...)
+	buf = append(buf, p...)
+	n, err := s.str.Write(buf)
+	if n < len(s.header) {
+		s.header = s.header[n:]
+		return 0, s.cancel.convert(err)
+	}
+	n -= len(s.header)
+	s.header = nil
+	return n, s.cancel.convert(err)
+}
+
+// Flush writes the stream header if it is still deferred.
+func (s *SendStream) Flush() error {
+	s.headerMutex.Lock()
+	defer s.headerMutex.Unlock()
+	if s.header == nil {
+		return nil
+	}
+	n, err := s.str.Write(s.header)
+	s.header = s.header[n:]
+	if len(s.header) == 0 {
+		s.header = nil
+	}
+	return s.cancel.convert(err)
+}
+
+// Close closes the write direction of the stream, a deferred header is
+// written first.
+func (s *SendStream) Close() error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	return s.cancel.convert(s.str.Close())
+}
+
+// CancelWrite resets the stream with a WebTransport error code.
+func (s *SendStream) CancelWrite(code StreamErrorCode) {
+	s.cancel.cancel(code)
+	s.str.CancelWrite(webtransportCodeToHTTPCode(code))
+}
+
+// Context is canceled as soon as the write side of the stream is closed.
+func (s *SendStream) Context() context.Context {
+	return s.str.Context()
+}
+
+func (s *SendStream) SetWriteDeadline(t time.Time) error {
+	return s.str.SetWriteDeadline(t)
+}
+
+// ReceiveStream is the receiving side of a WebTransport stream.
+type ReceiveStream struct {
+	str       quic.ReceiveStream
+	sessionId uint64
+	cancel    streamCancel
+}
+
+func newReceiveStream(str quic.ReceiveStream, sessionId uint64) *ReceiveStream {
+	return &ReceiveStream{str: str, sessionId: sessionId}
+}
+
+// SessionID returns the ID of the session the stream belongs to.
+func (s *ReceiveStream) SessionID() uint64 {
+	return s.sessionId
+}
+
+func (s *ReceiveStream) StreamID() quic.StreamID {
+	return s.str.StreamID()
+}
+
+func (s *ReceiveStream) Read(p []byte) (int, error) {
+	n, err := s.str.Read(p)
+	return n, s.cancel.convert(err)
+}
+
+// CancelRead stops the peer from sending with a WebTransport error code.
+func (s *ReceiveStream) CancelRead(code StreamErrorCode) {
+	s.cancel.cancel(code)
+	s.str.CancelRead(webtransportCodeToHTTPCode(code))
+}
+
+func (s *ReceiveStream) SetReadDeadline(t time.Time) error {
+	return s.str.SetReadDeadline(t)
+}
+
+// Stream is a bidirectional WebTransport stream.
+type Stream struct {
+	*SendStream
+	*ReceiveStream
+	str quic.Stream
+}
+
+func newStream(str quic.Stream, sessionId uint64) *Stream {
+	return &Stream{
+		SendStream:    newSendStream(str, sessionId),
+		ReceiveStream: newReceiveStream(str, sessionId),
+		str:           str,
+	}
+}
+
+// SessionID returns the ID of the session the stream belongs to.
+func (s *Stream) SessionID() uint64 {
+	return s.SendStream.sessionId
+}
+
+func (s *Stream) StreamID() quic.StreamID {
+	return s.str.StreamID()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	return s.str.SetDeadline(t)
+}
@@ -0,0 +1,164 @@
+package webtransport
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+func TestStreamErrorCodeMapping(t *testing.T) {
+	tests := []struct {
+		code StreamErrorCode
+		want quic.StreamErrorCode
+	}{
+		{0, firstErrorCode},
+		{0x1d, firstErrorCode + 0x1d},
+		// every 0x1f-th code from firstErrorCode + 0x1e is reserved and skipped
+		{0x1e, firstErrorCode + 0x1f},
+		{0x3b, firstErrorCode + 0x3c},
+		{0x3c, firstErrorCode + 0x3e},
+		{0xff, lastErrorCode},
+	}
+	for _, test := range tests {
+		if got := webtransportCodeToHTTPCode(test.code); got != test.want {
+			t.Fatalf("code 0x%x: got 0x%x, want 0x%x", test.code, uint64(got), uint64(test.want))
+		}
+	}
+
+	var previous quic.StreamErrorCode
+	for i := 0; i <= 0xff; i++ {
+		code := StreamErrorCode(i)
+		h := webtransportCodeToHTTPCode(code)
+		if i > 0 && h <= previous {
+			t.Fatalf("code 0x%x maps to 0x%x, not above 0x%x", i, uint64(h), uint64(previous))
+		}
+		previous = h
+		got, err := httpCodeToWebtransportCode(h)
+		if err != nil {
+			t.Fatalf("code 0x%x: %v", i, err)
+		}
+		if got != code {
+			t.Fatalf("code 0x%x round trips to 0x%x", i, got)
+		}
+	}
+}
+
+func TestStreamErrorCodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		code quic.StreamErrorCode
+	}{
+		{"zero", 0},
+		{"http/3 code", H3_INTERNAL_ERROR},
+		{"below the range", firstErrorCode - 1},
+		{"above the range", lastErrorCode + 1},
+		{"first reserved", firstErrorCode + 0x1e},
+		{"second reserved", firstErrorCode + 0x3d},
+		{"last reserved", firstErrorCode + 0xf7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code, err := httpCodeToWebtransportCode(test.code); err == nil {
+				t.Fatalf("0x%x mapped to %d", uint64(test.code), code)
+			}
+		})
+	}
+}
+
+// writeRecorder records the writes on a stream, limit cuts the next write short.
+type writeRecorder struct {
+	quic.Stream
+	writes [][]byte
+	closed bool
+	limit  int
+}
+
+func (s *writeRecorder) Write(p []byte) (int, error) {
+	if s.limit > 0 && s.limit < len(p) {
+		p = p[:s.limit]
+		s.limit = 0
+		s.writes = append(s.writes, append([]byte(nil), p...))
+		return len(p), errors.New("short write")
+	}
+	s.writes = append(s.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (s *writeRecorder) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestLazyStreamHeader(t *testing.T) {
+	header := encodeStreamHeader(WebTransportStream, 4)
+	payload := []byte("hello")
+
+	t.Run("eager", func(t *testing.T) {
+		str := &writeRecorder{}
+		if _, err := newOutgoingStream(str, 4, false); err != nil {
+			t.Fatal(err)
+		}
+		if len(str.writes) != 1 || !bytes.Equal(str.writes[0], header) {
+			t.Fatalf("writes %x, want the header right away", str.writes)
+		}
+	})
+
+	t.Run("first write", func(t *testing.T) {
+		str := &writeRecorder{}
+		stream, err := newOutgoingStream(str, 4, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(str.writes) != 0 {
+			t.Fatalf("header written before the first write: %x", str.writes)
+		}
+		n, err := stream.Write(payload)
+		if err != nil || n != len(payload) {
+			t.Fatalf("Write returned %d, %v", n, err)
+		}
+		if _, err := stream.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+		want := [][]byte{append(append([]byte(nil), header...), payload...), payload}
+		if len(str.writes) != 2 || !bytes.Equal(str.writes[0], want[0]) || !bytes.Equal(str.writes[1], want[1]) {
+			t.Fatalf("writes %x, want %x", str.writes, want)
+		}
+	})
+
+	t.Run("close without write", func(t *testing.T) {
+		str := &writeRecorder{}
+		stream, err := newOutgoingSendStream(str, 4, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Close(); err != nil {
+			t.Fatal(err)
+		}
+		uniHeader := encodeStreamHeader(WebTransportUniStream, 4)
+		if len(str.writes) != 1 || !bytes.Equal(str.writes[0], uniHeader) || !str.closed {
+			t.Fatalf("writes %x closed %v, want the header then close", str.writes, str.closed)
+		}
+	})
+
+	t.Run("short write", func(t *testing.T) {
+		str := &writeRecorder{limit: 1}
+		stream, err := newOutgoingStream(str, 4, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := stream.Write(payload); err == nil || n != 0 {
+			t.Fatalf("Write returned %d, %v, want 0 and the error", n, err)
+		}
+		if err := stream.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.Join(str.writes, nil); len(str.writes) != 2 || !bytes.Equal(got, header) {
+			t.Fatalf("writes %x, want the header once", str.writes)
+		}
+	})
+}
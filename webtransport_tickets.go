@@ -0,0 +1,65 @@
+package webtransport
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"time"
+)
+
+// DefaultSessionTicketKeyInterval is how often the keys of
+// ServerConfig.SessionTicketKeys are fetched when
+// ServerConfig.SessionTicketKeyInterval is not set.
+const DefaultSessionTicketKeyInterval = time.Hour
+
+// SessionTicketKeyProvider supplies the keys TLS session tickets are
+// encrypted with. Servers behind one load balancer share the provider, so a
+// ticket issued by one resumes the session, and sends 0-RTT data, on another.
+// The first key encrypts new tickets, all of them decrypt, rotate by putting
+// the new key first and keeping the old ones for a while.
+type SessionTicketKeyProvider interface {
+	SessionTicketKeys() ([][32]byte, error)
+}
+
+// SessionTicketKeyFunc adapts a function to SessionTicketKeyProvider.
+type SessionTicketKeyFunc func() ([][32]byte, error)
+
+func (f SessionTicketKeyFunc) SessionTicketKeys() ([][32]byte, error) {
+	return f()
+}
+
+// setSessionTicketKeys installs the current keys of the provider on config.
+func setSessionTicketKeys(config *tls.Config, provider SessionTicketKeyProvider) error {
+	keys, err := provider.SessionTicketKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("session ticket key provider returned no keys")
+	}
+	config.SetSessionTicketKeys(keys)
+	return nil
+}
+
+// watchSessionTicketKeys refreshes the keys of config every
+// SessionTicketKeyInterval until done is closed. Failed refreshes keep the
+// current keys.
+func (s *WebTransportServer) watchSessionTicketKeys(config *tls.Config, done <-chan struct{}) {
+	if s.SessionTicketKeys == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.SessionTicketKeyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := setSessionTicketKeys(config, s.SessionTicketKeys); err != nil {
+					log.Printf("session ticket key refresh failed, keep the current keys: %v", err)
+				}
+			}
+		}
+	}()
+}